@@ -0,0 +1,263 @@
+package mpvwebkaraoke
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OpenAPIDocument describes the JSON API under /api/v1.
+//
+//go:embed openapi.json
+var OpenAPIDocument []byte
+
+const maxAPIBody = 64 << 10
+
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeAPIErr responds with the status matching an error of a queue action.
+func writeAPIErr(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnauthorized):
+		writeAPIError(w, http.StatusForbidden, "forbidden")
+	case errors.Is(err, errSongNotFound), errors.Is(err, errNotPlaying):
+		writeAPIError(w, http.StatusNotFound, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func decodeAPIBody(r *http.Request, v any) error {
+	return json.NewDecoder(io.LimitReader(r.Body, maxAPIBody)).Decode(v)
+}
+
+type memberJSON struct {
+	User
+	Queued    int  `json:"queued"`
+	QueueOpen bool `json:"queueOpen"`
+}
+
+func newSongsJSON(songs []Song) []songJSON {
+	s := make([]songJSON, 0, len(songs))
+	for _, song := range songs {
+		s = append(s, newSongJSON(song))
+	}
+	return s
+}
+
+func (h *QueueHandler) HandleAPIOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(OpenAPIDocument)
+}
+
+func (h *QueueHandler) HandleAPIQueue(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"songs": newSongsJSON(h.queue.List())})
+}
+
+func (h *QueueHandler) HandleAPICurrent(w http.ResponseWriter, r *http.Request) {
+	var current *songJSON
+	if song, ok := h.queue.LastDequeued(); ok {
+		s := newSongJSON(song)
+		current = &s
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"song": current})
+}
+
+func (h *QueueHandler) HandleAPIMembers(w http.ResponseWriter, r *http.Request) {
+	members := h.members()
+	m := make([]memberJSON, 0, len(members))
+	for _, member := range members {
+		m = append(m, memberJSON{User: member.User, Queued: member.Queued, QueueOpen: member.QueueOpen})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"members": m})
+}
+
+// HandleAPIHistory lists played songs, most recent first, up to the limit
+// query parameter.
+func (h *QueueHandler) HandleAPIHistory(w http.ResponseWriter, r *http.Request) {
+	history := h.queue.History()
+
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		history = history[:min(limit, len(history))]
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"songs": newSongsJSON(history)})
+}
+
+type apiSubmission struct {
+	URL          string  `json:"url"`
+	LyricsURL    string  `json:"lyricsUrl"`
+	Subtitle     string  `json:"subtitle"`
+	Key          int     `json:"key"`
+	Speed        float64 `json:"speed"`
+	ReduceVocals bool    `json:"reduceVocals"`
+}
+
+// HandleAPISubmission requests a song, looking up its title and duration like
+// the preview does.
+func (h *QueueHandler) HandleAPISubmission(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if err := h.moderation.CheckRequest(user.ID); err != nil {
+		writeAPIError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	if !user.Can(PermRequest) {
+		writeAPIError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	submission := apiSubmission{Speed: 1}
+	if err := decodeAPIBody(r, &submission); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	if !checkURL(submission.URL) {
+		writeAPIError(w, http.StatusBadRequest, "invalid URL")
+		return
+	}
+
+	if submission.LyricsURL != "" && !checkURL(submission.LyricsURL) {
+		writeAPIError(w, http.StatusBadRequest, "invalid lyrics URL")
+		return
+	}
+
+	if !validKey(submission.Key) {
+		writeAPIError(w, http.StatusBadRequest, errKeyRange.Error())
+		return
+	}
+
+	if !validSpeed(submission.Speed) {
+		writeAPIError(w, http.StatusBadRequest, errSpeedRange.Error())
+		return
+	}
+
+	video, err := getVideoInfo(r.Context(), submission.URL)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	subtitle := parseSubtitle(submission.Subtitle)
+	switch err := h.checkSubtitle(r.Context(), submission.URL, subtitle); {
+	case errors.Is(err, errNoSubtitle):
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	song, err := h.queue.Push(Song{
+		Requester:    user,
+		Title:        video.title,
+		URL:          submission.URL,
+		Duration:     video.duration,
+		LyricsURL:    sql.NullString{String: submission.LyricsURL, Valid: submission.LyricsURL != ""},
+		Subtitle:     subtitle,
+		Key:          submission.Key,
+		Speed:        submission.Speed,
+		ReduceVocals: submission.ReduceVocals,
+		Thumbnail:    video.thumbnail,
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newSongJSON(song))
+}
+
+func (h *QueueHandler) HandleAPIRevoke(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid ID")
+		return
+	}
+
+	if err := h.revoke(user, id); err != nil {
+		writeAPIErr(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *QueueHandler) HandleAPISkip(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid ID")
+		return
+	}
+
+	if err := h.skip(user, id); err != nil {
+		writeAPIErr(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAPIAdjust changes the playback settings given in the body of a queued
+// or currently playing song.
+func (h *QueueHandler) HandleAPIAdjust(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermPlaybackControl) {
+		writeAPIError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid ID")
+		return
+	}
+
+	var adjustment playbackAdjustment
+	if err := decodeAPIBody(r, &adjustment); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	updates, err := adjustment.updates()
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.adjust(id, updates); err != nil {
+		writeAPIErr(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
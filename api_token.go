@@ -0,0 +1,201 @@
+package mpvwebkaraoke
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiTokenPrefix starts every API token so they are easy to recognize.
+const apiTokenPrefix = "mpvk_"
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// APIToken lets scripts act as the user who created it, limited to its scopes.
+// Only a hash of the secret is kept. User has no permissions, they are looked
+// up from the user's login whenever the token is used.
+type APIToken struct {
+	ID       string
+	Name     string
+	User     User
+	Scopes   Permissions
+	Hash     [sha256.Size]byte
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// Permissions returns what the token may do, the scopes its user still has.
+func (t APIToken) Permissions(user Permissions) Permissions {
+	return user & t.Scopes
+}
+
+// TokenStore keeps API tokens, writing changes to disk right away.
+type TokenStore struct {
+	mu     sync.RWMutex
+	path   string
+	tokens map[string]APIToken
+}
+
+// NewTokenStore loads tokens from the file at path, which is created on the
+// first change. Nothing is persisted if path is empty.
+func NewTokenStore(path string) (*TokenStore, error) {
+	s := &TokenStore{path: path, tokens: make(map[string]APIToken)}
+	if path == "" {
+		return s, nil
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	if err := gob.NewDecoder(file).Decode(&s.tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode tokens: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *TokenStore) persistLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	tempFile, err := os.CreateTemp("", "tokens.*.gob")
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(tempFile).Encode(s.tokens); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), s.path)
+}
+
+// Create makes a token for a user and returns its secret, which cannot be
+// recovered later.
+func (s *TokenStore) Create(user User, name string, scopes Permissions) (string, APIToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIToken{}, err
+	}
+
+	raw := apiTokenPrefix + hex.EncodeToString(secret)
+	user.Permissions = 0
+	token := APIToken{
+		ID:      newState()[:16],
+		Name:    name,
+		User:    user,
+		Scopes:  scopes,
+		Hash:    sha256.Sum256([]byte(raw)),
+		Created: time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[token.ID] = token
+	if err := s.persistLocked(); err != nil {
+		delete(s.tokens, token.ID)
+		return "", APIToken{}, err
+	}
+
+	return raw, token, nil
+}
+
+// Authenticate returns the token with the given secret.
+func (s *TokenStore) Authenticate(raw string) (APIToken, bool) {
+	if !strings.HasPrefix(raw, apiTokenPrefix) {
+		return APIToken{}, false
+	}
+
+	hash := sha256.Sum256([]byte(raw))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the hashes are of long random secrets, so comparing them does not leak
+	// anything useful through timing
+	for id, t := range s.tokens {
+		if t.Hash == hash {
+			t.LastUsed = time.Now()
+			s.tokens[id] = t
+			return t, true
+		}
+	}
+
+	return APIToken{}, false
+}
+
+// List returns the tokens of a user, or every token if userID is empty.
+func (s *TokenStore) List(userID string) []APIToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := make([]APIToken, 0)
+	for _, t := range s.tokens {
+		if userID == "" || t.User.ID == userID {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func (s *TokenStore) Get(id string) (APIToken, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tokens[id]
+	return t, ok
+}
+
+func (s *TokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tokens[id]; !ok {
+		return ErrTokenNotFound
+	}
+
+	delete(s.tokens, id)
+	return s.persistLocked()
+}
+
+// SyncUser updates the tokens of a user after their name or avatar changed.
+func (s *TokenStore) SyncUser(user User) error {
+	user.Permissions = 0
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for id, t := range s.tokens {
+		if t.User.ID == user.ID && t.User != user {
+			t.User = user
+			s.tokens[id] = t
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return s.persistLocked()
+}
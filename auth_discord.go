@@ -0,0 +1,110 @@
+package mpvwebkaraoke
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/a-h/templ"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+type guildMember struct {
+	User  User     `json:"user"`
+	Nick  *string  `json:"nick"`
+	Roles []string `json:"roles"`
+}
+
+// user returns the member by their nickname, with the base permissions and
+// those of their roles.
+func (m guildMember) user(roles RolePermissions, base Permissions) User {
+	user := m.User
+	user.Permissions = roles.For(m.Roles, base)
+
+	if m.Nick != nil {
+		user.Name = *m.Nick
+	}
+
+	return user
+}
+
+// DiscordProvider logs in members of a Discord guild with OAuth. Members get
+// the base permissions and those of their roles.
+type DiscordProvider struct {
+	conf    *oauth2.Config
+	guildID string
+	roles   RolePermissions
+	base    Permissions
+}
+
+func NewDiscordProvider(config *oauth2.Config, guildID string, roles RolePermissions, base Permissions) *DiscordProvider {
+	return &DiscordProvider{conf: config, guildID: guildID, roles: roles, base: base}
+}
+
+func (p *DiscordProvider) Name() string {
+	return "discord"
+}
+
+func (p *DiscordProvider) Login(r *http.Request) templ.Component {
+	return loginLink("/auth/discord", "Log in with Discord")
+}
+
+func (p *DiscordProvider) LoginURL(session *sessions.Session) string {
+	state := newState()
+	session.Values["state"] = state
+	return p.conf.AuthCodeURL(state)
+}
+
+func (p *DiscordProvider) Authenticate(w http.ResponseWriter, r *http.Request, session *sessions.Session) (User, *oauth2.Token, error) {
+	state, _ := session.Values["state"].(string)
+
+	if state == "" || r.FormValue("state") != state {
+		return User{}, nil, fmt.Errorf("%w: invalid state", errInvalidLogin)
+	}
+
+	token, err := p.conf.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		return User{}, nil, fmt.Errorf("failed to exchange token: %w", err)
+	}
+
+	user, err := p.member(r.Context(), token)
+	return user, token, err
+}
+
+// Refresh fetches the user's guild membership again, so users who left the
+// guild are logged out and role changes apply.
+func (p *DiscordProvider) Refresh(ctx context.Context, user User, token *oauth2.Token) (User, *oauth2.Token, error) {
+	token, err := refreshToken(ctx, p.conf, token)
+	if err != nil {
+		return User{}, nil, err
+	}
+
+	user, err = p.member(ctx, token)
+	return user, token, err
+}
+
+func (p *DiscordProvider) member(ctx context.Context, token *oauth2.Token) (User, error) {
+	client := p.conf.Client(ctx, token)
+	resp, err := client.Get("https://discord.com/api/users/@me/guilds/" + p.guildID + "/member")
+	if err != nil {
+		return User{}, fmt.Errorf("failed to get user info: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound:
+		return User{}, fmt.Errorf("%w: failed to get guild membership", errInvalidLogin)
+	case resp.StatusCode != http.StatusOK:
+		return User{}, fmt.Errorf("failed to get guild membership: %s", resp.Status)
+	}
+
+	var member guildMember
+	if err := json.NewDecoder(resp.Body).Decode(&member); err != nil {
+		return User{}, fmt.Errorf("failed to decode user info: %w", err)
+	}
+
+	return member.user(p.roles, p.base), nil
+}
@@ -4,129 +4,433 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
-	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/a-h/templ"
 	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
 )
 
 var userKey = "user"
 
+// apiTokenKey holds the ID of the API token a request was made with.
+var apiTokenKey = "apiToken"
+
+// refreshUserKey holds a refreshUser for the login or token of a request.
+var refreshUserKey = "refreshUser"
+
+// refreshUser returns the user of a request as they are now, checked like
+// with WrapSensitive. It reports false once they may no longer log in, for
+// handlers that keep running after the request, like WebSockets.
+type refreshUser func(ctx context.Context) (User, bool)
+
 type User struct {
-	ID            string `json:"id"`
-	Avatar        string `json:"avatar"`
-	Discriminator string `json:"discriminator"`
-	Name          string `json:"username"`
-	Admin         bool   `json:"-"`
+	ID            string      `json:"id"`
+	Avatar        string      `json:"avatar"`
+	Discriminator string      `json:"discriminator"`
+	Name          string      `json:"username"`
+	Permissions   Permissions `json:"-"`
 }
 
-type guildMember struct {
-	User  User     `json:"user"`
-	Nick  *string  `json:"nick"`
-	Roles []string `json:"roles"`
+func (u User) Can(perm Permissions) bool {
+	return u.Permissions.Has(perm)
 }
 
-type AuthHandler struct {
-	store       sessions.Store
-	conf        *oauth2.Config
-	guildID     string
-	adminRoleID string
+func (u User) avatarURL(size int) string {
+	if u.Avatar == "" {
+		return u.defaultAvatarURL()
+	}
+
+	return fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png?size=%d", u.ID, u.Avatar, size)
+}
+
+func (u User) defaultAvatarURL() string {
+	var index int
+
+	if u.Discriminator == "0" {
+		id, _ := strconv.Atoi(u.ID)
+		index = (id >> 22) % 6
+	} else {
+		disc, _ := strconv.Atoi(u.Discriminator)
+		index = disc % 5
+	}
+
+	return fmt.Sprintf("https://cdn.discordapp.com/embed/avatars/%d.png", index)
+}
+
+// errInvalidLogin is wrapped by errors that should be shown to the user on
+// the login page, such as a wrong password.
+var errInvalidLogin = errors.New("invalid login")
+
+// AuthProvider authenticates users and produces the User stored in their session.
+type AuthProvider interface {
+	// Name identifies the provider in its routes, /auth/{name} and /auth/{name}/callback.
+	Name() string
+	// Login renders the provider's entry on the login page.
+	Login(r *http.Request) templ.Component
+	// Authenticate completes a login submitted to the callback route. The
+	// token is kept on the server for refreshing, and is nil for local providers.
+	Authenticate(w http.ResponseWriter, r *http.Request, session *sessions.Session) (User, *oauth2.Token, error)
 }
 
-func NewAuthHandler(store sessions.Store, config *oauth2.Config, guildID, adminRoleID string) *AuthHandler {
-	return &AuthHandler{store: store, conf: config, guildID: guildID, adminRoleID: adminRoleID}
+// RedirectAuthProvider is implemented by providers that log users in through
+// another site, such as OAuth providers.
+type RedirectAuthProvider interface {
+	AuthProvider
+	// LoginURL starts a login, storing any state Authenticate needs in the session.
+	LoginURL(session *sessions.Session) string
 }
 
-func (h *AuthHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
-	var state string
+// RefreshAuthProvider is implemented by providers that can check users again
+// after they logged in. Refresh returns an error wrapping errInvalidLogin if
+// the user may no longer log in.
+type RefreshAuthProvider interface {
+	AuthProvider
+	Refresh(ctx context.Context, user User, token *oauth2.Token) (User, *oauth2.Token, error)
+}
 
+// refreshToken gets a new access token if the old one expired.
+func refreshToken(ctx context.Context, conf *oauth2.Config, token *oauth2.Token) (*oauth2.Token, error) {
+	if token == nil {
+		return nil, fmt.Errorf("%w: no token to refresh", errInvalidLogin)
+	}
+
+	newToken, err := conf.TokenSource(ctx, token).Token()
+
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response.StatusCode < 500 {
+		return nil, fmt.Errorf("%w: %w", errInvalidLogin, err)
+	}
+
+	return newToken, err
+}
+
+// sensitiveRefreshInterval is how often users are checked again when they do
+// something sensitive, such as admin actions.
+const sensitiveRefreshInterval = time.Minute
+
+func newState() string {
 	b := make([]byte, 16)
 	rand.Read(b)
-	state = hex.EncodeToString(b)
+	return hex.EncodeToString(b)
+}
+
+type AuthHandler struct {
+	store      sessions.Store
+	logins     *LoginStore
+	moderation *Moderation
+	tokens     *TokenStore
+	providers  []AuthProvider
+}
 
+func NewAuthHandler(store sessions.Store, logins *LoginStore, moderation *Moderation, tokens *TokenStore, providers ...AuthProvider) *AuthHandler {
+	return &AuthHandler{store: store, logins: logins, moderation: moderation, tokens: tokens, providers: providers}
+}
+
+// syncTokens passes changes to a user on to their API tokens.
+func (h *AuthHandler) syncTokens(user User) {
+	if err := h.tokens.SyncUser(user); err != nil {
+		log.Println("error updating API tokens of", user.Name+":", err)
+	}
+}
+
+func (h *AuthHandler) provider(name string) (AuthProvider, bool) {
+	for _, p := range h.providers {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func (h *AuthHandler) redirectToLogin(w http.ResponseWriter, r *http.Request, p RedirectAuthProvider) {
 	session, _ := h.store.Get(r, "auth")
-	session.Values["state"] = state
+	url := p.LoginURL(session)
 	session.Save(r, w)
 
-	url := h.conf.AuthCodeURL(state)
 	w.Header().Set("HX-Redirect", url)
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
-func (h *AuthHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
+// HandleIndex shows the login page, or goes straight to the login of the only
+// provider if it is a redirect provider.
+func (h *AuthHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
+	if len(h.providers) == 1 {
+		if p, ok := h.providers[0].(RedirectAuthProvider); ok {
+			h.redirectToLogin(w, r, p)
+			return
+		}
+	}
+
+	h.renderLoginPage(w, r, "")
+}
+
+// renderLoginPage shows the login page with a CSRF token for its forms.
+func (h *AuthHandler) renderLoginPage(w http.ResponseWriter, r *http.Request, errorMessage string) {
 	session, _ := h.store.Get(r, "auth")
-	state := session.Values["state"].(string)
+	token, created := sessionCSRFToken(session)
+	if created {
+		session.Save(r, w)
+	}
+
+	if errorMessage != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
 
-	if r.FormValue("state") != state {
-		http.Error(w, "invalid state", http.StatusBadRequest)
+	ctx := withCSRFToken(r.Context(), token)
+	loginPage(r, h.providers, errorMessage).Render(ctx, w)
+}
+
+func (h *AuthHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.provider(r.PathValue("provider"))
+	if !ok {
+		http.NotFound(w, r)
 		return
 	}
 
-	token, err := h.conf.Exchange(r.Context(), r.FormValue("code"))
-	if err != nil {
-		http.Error(w, "failed to exchange token", http.StatusInternalServerError)
+	rp, ok := p.(RedirectAuthProvider)
+	if !ok {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
 		return
 	}
 
-	client := h.conf.Client(r.Context(), token)
-	resp, err := client.Get("https://discord.com/api/users/@me/guilds/" + h.guildID + "/member")
+	h.redirectToLogin(w, r, rp)
+}
+
+func (h *AuthHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	h.handleCallback(w, r, r.PathValue("provider"))
+}
 
-	if resp.StatusCode != http.StatusOK {
-		http.Error(w, "failed to get user info", http.StatusInternalServerError)
-		return
+// HandleCallbackFor returns a callback handler for a fixed provider, for
+// redirect URLs registered before providers had their own routes.
+func (h *AuthHandler) HandleCallbackFor(provider string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.handleCallback(w, r, provider)
 	}
+}
 
-	if err != nil {
-		http.Error(w, "failed to get user info", http.StatusInternalServerError)
+func (h *AuthHandler) handleCallback(w http.ResponseWriter, r *http.Request, name string) {
+	p, ok := h.provider(name)
+	if !ok {
+		http.NotFound(w, r)
 		return
 	}
 
-	var member guildMember
-	if err := json.NewDecoder(resp.Body).Decode(&member); err != nil {
-		http.Error(w, "failed to decode user info", http.StatusInternalServerError)
+	session, _ := h.store.Get(r, "auth")
+	csrf, _ := session.Values["csrf"].(string)
+	if !checkCSRF(r, csrf) {
+		h.renderLoginPage(w, r, "Your login form expired, please try again.")
 		return
 	}
 
-	if slices.Contains(member.Roles, h.adminRoleID) {
-		member.User.Admin = true
-	}
+	user, token, err := p.Authenticate(w, r, session)
 
-	if member.Nick != nil {
-		member.User.Name = *member.Nick
+	if errors.Is(err, errInvalidLogin) {
+		h.renderLoginPage(w, r, err.Error())
+		return
 	}
 
-	session.Values["user"] = member.User
-	err = session.Save(r, w)
 	if err != nil {
-		println(err.Error())
+		log.Println("login with", name, "failed:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	login := h.logins.Add(name, user, token)
+	h.syncTokens(user)
+	delete(session.Values, "state")
+	delete(session.Values, "nonce")
+	// a new token for the new login
+	delete(session.Values, "csrf")
+	session.Values["login"] = login.ID
+	if err := session.Save(r, w); err != nil {
+		log.Println("error saving session:", err)
+	}
+
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (h *AuthHandler) HandleLogout(w http.ResponseWriter, r *http.Request) {
 	session, _ := h.store.Get(r, "auth")
-	delete(session.Values, "user")
+	if id, ok := session.Values["login"].(string); ok {
+		h.logins.Remove(id)
+	}
+	delete(session.Values, "login")
 	session.Save(r, w)
 
 	w.Header().Set("HX-Redirect", "/")
 	w.WriteHeader(http.StatusSeeOther)
 }
 
-func (h *AuthHandler) Wrap(next http.HandlerFunc) http.HandlerFunc {
+// check refreshes the user of a login with its provider if it was last
+// checked longer than interval ago. It reports false if the user may no
+// longer log in.
+func (h *AuthHandler) check(ctx context.Context, login Login, interval time.Duration) (User, bool) {
+	p, ok := h.provider(login.Provider)
+	if !ok {
+		return User{}, false
+	}
+
+	rp, ok := p.(RefreshAuthProvider)
+	if !ok || !h.logins.Claim(login.ID, interval) {
+		return login.User, true
+	}
+
+	user, token, err := rp.Refresh(ctx, login.User, login.Token)
+	if errors.Is(err, errInvalidLogin) {
+		log.Println("logging out", login.User.Name+":", err)
+		h.logins.Remove(login.ID)
+		return User{}, false
+	}
+
+	if err != nil {
+		log.Println("error refreshing", login.User.Name+":", err)
+		return login.User, true
+	}
+
+	h.logins.Update(login.ID, user, token)
+	h.syncTokens(user)
+	return user, true
+}
+
+// current returns the user of a login, checking them again if the interval
+// is not zero. It reports false if the user may no longer log in.
+func (h *AuthHandler) current(ctx context.Context, login Login, interval time.Duration) (User, bool) {
+	if interval > 0 {
+		return h.check(ctx, login, interval)
+	}
+	return login.User, true
+}
+
+// loginUser returns the user of a login with the permissions they may use.
+func (h *AuthHandler) loginUser(ctx context.Context, id string, interval time.Duration) (User, bool) {
+	login, ok := h.logins.Get(id)
+	if !ok {
+		return User{}, false
+	}
+
+	user, ok := h.current(ctx, login, interval)
+	if !ok {
+		return User{}, false
+	}
+
+	return h.moderation.Restrict(user), true
+}
+
+// tokenUser returns the user of an API token. The token gets the permissions
+// its user has now, so it stops working once the user cannot log in anymore.
+func (h *AuthHandler) tokenUser(ctx context.Context, token APIToken, interval time.Duration) (User, bool) {
+	login, ok := h.logins.Latest(token.User.ID)
+	if !ok {
+		return User{}, false
+	}
+
+	user, ok := h.current(ctx, login, interval)
+	if !ok {
+		return User{}, false
+	}
+
+	user.Permissions = token.Permissions(user.Permissions)
+	return h.moderation.Restrict(user), true
+}
+
+// wrapToken authenticates a request made with an API token. Browsers do not
+// send these on their own, so no CSRF token is needed.
+func (h *AuthHandler) wrapToken(next http.HandlerFunc, w http.ResponseWriter, r *http.Request, raw string, interval time.Duration) {
+	token, ok := h.tokens.Authenticate(raw)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeAPIError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	user, ok := h.tokenUser(r.Context(), token, interval)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeAPIError(w, http.StatusUnauthorized, "the token's user is no longer logged in")
+		return
+	}
+
+	refresh := refreshUser(func(ctx context.Context) (User, bool) {
+		// the token may have been revoked since
+		token, ok := h.tokens.Get(token.ID)
+		if !ok {
+			return User{}, false
+		}
+		return h.tokenUser(ctx, token, h.sensitiveInterval())
+	})
+
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, userKey, user)
+	ctx = context.WithValue(ctx, apiTokenKey, token.ID)
+	ctx = context.WithValue(ctx, refreshUserKey, refresh)
+	next(w, r.WithContext(ctx))
+}
+
+func (h *AuthHandler) wrap(next http.HandlerFunc, interval time.Duration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			h.wrapToken(next, w, r, raw, interval)
+			return
+		}
+
 		session, _ := h.store.Get(r, "auth")
-		user, ok := session.Values["user"].(User)
-		if !ok {
+		id, _ := session.Values["login"].(string)
+		user, ok := h.loginUser(r.Context(), id, interval)
+
+		if !ok && isAPIRequest(r) {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		} else if !ok {
 			w.Header().Set("HX-Redirect", "/auth")
 			http.Redirect(w, r, "/auth", http.StatusSeeOther)
 			return
 		}
 
+		token, created := sessionCSRFToken(session)
+		if !checkCSRF(r, token) {
+			http.Error(w, "invalid CSRF token, reload the page and try again", http.StatusForbidden)
+			return
+		}
+
+		if created {
+			session.Save(r, w)
+		}
+
+		refresh := refreshUser(func(ctx context.Context) (User, bool) {
+			return h.loginUser(ctx, id, h.sensitiveInterval())
+		})
+
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, userKey, user)
+		ctx = context.WithValue(ctx, refreshUserKey, refresh)
+		ctx = withCSRFToken(ctx, token)
 		r = r.WithContext(ctx)
 		next(w, r)
 	}
 }
+
+// Wrap requires a login, checking the user again every refresh interval.
+func (h *AuthHandler) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return h.wrap(next, h.logins.config.RefreshInterval)
+}
+
+// WrapSensitive is like Wrap but checks the user more often, for actions
+// that should stop as soon as a user loses their role.
+func (h *AuthHandler) WrapSensitive(next http.HandlerFunc) http.HandlerFunc {
+	return h.wrap(next, h.sensitiveInterval())
+}
+
+func (h *AuthHandler) sensitiveInterval() time.Duration {
+	interval := sensitiveRefreshInterval
+	if h.logins.config.RefreshInterval > 0 {
+		interval = min(interval, h.logins.config.RefreshInterval)
+	}
+	return interval
+}
@@ -0,0 +1,79 @@
+package mpvwebkaraoke
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/a-h/templ"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+const maxNicknameLength = 32
+
+// PINProvider lets guests join with a nickname and the room PIN.
+type PINProvider struct {
+	pin         *RoomPIN
+	permissions Permissions
+}
+
+func NewPINProvider(pin *RoomPIN, permissions Permissions) *PINProvider {
+	return &PINProvider{pin: pin, permissions: permissions}
+}
+
+func (p *PINProvider) Name() string {
+	return "pin"
+}
+
+func (p *PINProvider) Login(r *http.Request) templ.Component {
+	return pinLoginForm(r.URL.Query().Get("pin"))
+}
+
+func (p *PINProvider) Authenticate(w http.ResponseWriter, r *http.Request, session *sessions.Session) (User, *oauth2.Token, error) {
+	if !p.pin.Check(strings.TrimSpace(r.FormValue("pin"))) {
+		return User{}, nil, fmt.Errorf("%w: wrong PIN", errInvalidLogin)
+	}
+
+	nickname := strings.TrimSpace(r.FormValue("nickname"))
+	if nickname == "" || utf8.RuneCountInString(nickname) > maxNicknameLength {
+		return User{}, nil, fmt.Errorf("%w: nickname must be 1 to %d characters", errInvalidLogin, maxNicknameLength)
+	}
+
+	// the guest keeps their ID when joining again from the same browser, so
+	// logging in again does not escape moderation or queue limits
+	id, _ := session.Values["guest"].(string)
+	if id == "" {
+		id = "guest:" + newState()
+		session.Values["guest"] = id
+	}
+
+	return User{ID: id, Name: nickname, Permissions: p.permissions}, nil, nil
+}
+
+// PasswordProvider logs in a single local admin with a password.
+type PasswordProvider struct {
+	password string
+}
+
+func NewPasswordProvider(password string) *PasswordProvider {
+	return &PasswordProvider{password: password}
+}
+
+func (p *PasswordProvider) Name() string {
+	return "password"
+}
+
+func (p *PasswordProvider) Login(r *http.Request) templ.Component {
+	return passwordLoginForm()
+}
+
+func (p *PasswordProvider) Authenticate(w http.ResponseWriter, r *http.Request, session *sessions.Session) (User, *oauth2.Token, error) {
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("password")), []byte(p.password)) != 1 {
+		return User{}, nil, fmt.Errorf("%w: wrong password", errInvalidLogin)
+	}
+
+	return User{ID: "local:admin", Name: "Admin", Permissions: AllPermissions}, nil, nil
+}
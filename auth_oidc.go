@@ -0,0 +1,180 @@
+package mpvwebkaraoke
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/a-h/templ"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Scopes are requested besides openid, offline_access and profile, for
+	// providers that need one to include the groups.
+	Scopes []string
+	// GroupsClaim is the ID token or userinfo claim listing the user's groups.
+	GroupsClaim string
+	// Groups maps groups to permissions, added to the base Permissions.
+	Groups      RolePermissions
+	Permissions Permissions
+}
+
+// OIDCProvider logs users in with any OpenID Connect identity provider.
+type OIDCProvider struct {
+	config   OIDCConfig
+	provider *oidc.Provider
+	conf     *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCProvider discovers the issuer's endpoints.
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+
+	scopes := append([]string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess, "profile"}, config.Scopes...)
+
+	return &OIDCProvider{
+		config:   config,
+		provider: provider,
+		conf: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Scopes:       scopes,
+			Endpoint:     provider.Endpoint(),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}, nil
+}
+
+func (p *OIDCProvider) Name() string {
+	return "oidc"
+}
+
+func (p *OIDCProvider) Login(r *http.Request) templ.Component {
+	return loginLink("/auth/oidc", "Log in with single sign-on")
+}
+
+func (p *OIDCProvider) LoginURL(session *sessions.Session) string {
+	state, nonce := newState(), newState()
+	session.Values["state"] = state
+	session.Values["nonce"] = nonce
+	return p.conf.AuthCodeURL(state, oidc.Nonce(nonce))
+}
+
+func (p *OIDCProvider) Authenticate(w http.ResponseWriter, r *http.Request, session *sessions.Session) (User, *oauth2.Token, error) {
+	state, _ := session.Values["state"].(string)
+	nonce, _ := session.Values["nonce"].(string)
+
+	if state == "" || r.FormValue("state") != state {
+		return User{}, nil, fmt.Errorf("%w: invalid state", errInvalidLogin)
+	}
+
+	token, err := p.conf.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		return User{}, nil, fmt.Errorf("failed to exchange token: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return User{}, nil, fmt.Errorf("no ID token in token response")
+	}
+
+	idToken, err := p.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		return User{}, nil, fmt.Errorf("failed to verify ID token: %w", err)
+	}
+
+	if idToken.Nonce != nonce {
+		return User{}, nil, fmt.Errorf("%w: invalid nonce", errInvalidLogin)
+	}
+
+	user, err := p.user(r.Context(), idToken, token)
+	return user, token, err
+}
+
+// Refresh gets a new token, which fails if the user was disabled, and takes
+// the user's groups from a new ID token if the provider issues one.
+func (p *OIDCProvider) Refresh(ctx context.Context, user User, token *oauth2.Token) (User, *oauth2.Token, error) {
+	token, err := refreshToken(ctx, p.conf, token)
+	if err != nil {
+		return User{}, nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return user, token, nil
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return User{}, nil, fmt.Errorf("failed to verify ID token: %w", err)
+	}
+
+	user, err = p.user(ctx, idToken, token)
+	return user, token, err
+}
+
+func (p *OIDCProvider) user(ctx context.Context, idToken *oidc.IDToken, token *oauth2.Token) (User, error) {
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return User{}, fmt.Errorf("failed to decode claims: %w", err)
+	}
+
+	user := User{ID: "oidc:" + idToken.Subject}
+	for _, claim := range []string{"name", "preferred_username", "email"} {
+		if name, _ := claims[claim].(string); name != "" {
+			user.Name = name
+			break
+		}
+	}
+
+	if user.Name == "" {
+		user.Name = idToken.Subject
+	}
+
+	claimed, ok := claims[p.config.GroupsClaim].([]any)
+	if !ok && len(p.config.Groups) > 0 {
+		// some providers only list groups in the userinfo
+		var err error
+		if claimed, err = p.userInfoGroups(ctx, token); err != nil {
+			return User{}, err
+		}
+	}
+
+	groups := make([]string, 0)
+	for _, group := range claimed {
+		if group, ok := group.(string); ok {
+			groups = append(groups, group)
+		}
+	}
+
+	user.Permissions = p.config.Groups.For(groups, p.config.Permissions)
+
+	return user, nil
+}
+
+func (p *OIDCProvider) userInfoGroups(ctx context.Context, token *oauth2.Token) ([]any, error) {
+	info, err := p.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get userinfo: %w", err)
+	}
+
+	var claims map[string]any
+	if err := info.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode userinfo claims: %w", err)
+	}
+
+	groups, _ := claims[p.config.GroupsClaim].([]any)
+	return groups, nil
+}
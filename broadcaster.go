@@ -0,0 +1,112 @@
+package mpvwebkaraoke
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before it
+// is dropped.
+const subscriberBuffer = 64
+
+// historySize is how many recent events are kept for clients that reconnect.
+const historySize = 256
+
+type subscriber struct {
+	events chan queueEvent
+	// lagged is closed when the subscriber is dropped for falling behind.
+	lagged chan struct{}
+	// lastID is the ID of the last event published before subscribing.
+	lastID string
+}
+
+// broadcaster fans events out to subscribers without ever blocking, so it is
+// safe to publish while holding the queue lock. Subscribers that cannot keep
+// up are dropped and have to subscribe again and resync.
+//
+// Every event gets an ID, and the latest events are kept so that clients can
+// pick up where they left off after reconnecting.
+type broadcaster struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	// epoch tells IDs from before a restart apart.
+	epoch   string
+	lastSeq uint64
+	history [historySize]queueEvent
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{
+		subscribers: make(map[*subscriber]struct{}),
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+}
+
+func (b *broadcaster) formatID(seq uint64) string {
+	return fmt.Sprintf("%s-%d", b.epoch, seq)
+}
+
+func (b *broadcaster) parseID(id string) (seq uint64, ok bool) {
+	epoch, seqString, ok := strings.Cut(id, "-")
+	if !ok || epoch != b.epoch {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseUint(seqString, 10, 64)
+	return seq, err == nil
+}
+
+// subscribe starts sending events to a new subscriber. If lastEventID is the
+// ID of a recent event, the events since are returned to be replayed. It
+// reports false if they cannot be, and the subscriber has to start from the
+// current queue instead.
+func (b *broadcaster) subscribe(lastEventID string) (s *subscriber, replay []queueEvent, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s = &subscriber{
+		events: make(chan queueEvent, subscriberBuffer),
+		lagged: make(chan struct{}),
+		lastID: b.formatID(b.lastSeq),
+	}
+	b.subscribers[s] = struct{}{}
+
+	seq, ok := b.parseID(lastEventID)
+	if !ok || seq > b.lastSeq || b.lastSeq-seq > historySize {
+		return s, nil, false
+	}
+
+	for seq < b.lastSeq {
+		seq++
+		replay = append(replay, b.history[seq%historySize])
+	}
+
+	return s, replay, true
+}
+
+func (b *broadcaster) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, s)
+}
+
+func (b *broadcaster) publish(e queueEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastSeq++
+	e.ID = b.formatID(b.lastSeq)
+	b.history[b.lastSeq%historySize] = e
+
+	for s := range b.subscribers {
+		select {
+		case s.events <- e:
+		default:
+			delete(b.subscribers, s)
+			close(s.lagged)
+		}
+	}
+}
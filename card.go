@@ -0,0 +1,471 @@
+package mpvwebkaraoke
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
+)
+
+// CardTemplate describes the layout of the intermission card shown before a song.
+type CardTemplate struct {
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	Padding       int     `json:"padding"`
+	Background    string  `json:"background"`
+	Foreground    string  `json:"foreground"`
+	Accent        string  `json:"accent"`
+	TitleSize     float64 `json:"titleSize"`
+	TextSize      float64 `json:"textSize"`
+	ShowThumbnail bool    `json:"showThumbnail"`
+	ShowAvatar    bool    `json:"showAvatar"`
+	UpNextCount   int     `json:"upNextCount"`
+	ShowJoinCode  bool    `json:"showJoinCode"`
+}
+
+var DefaultCardTemplate = CardTemplate{
+	Width:         1920,
+	Height:        1080,
+	Padding:       120,
+	Background:    "#171717",
+	Foreground:    "#f5f5f5",
+	Accent:        "#f9a8d4",
+	TitleSize:     72,
+	TextSize:      44,
+	ShowThumbnail: true,
+	ShowAvatar:    true,
+	UpNextCount:   3,
+	ShowJoinCode:  true,
+}
+
+// LoadCardTemplate reads a JSON template, using the default for missing fields.
+func LoadCardTemplate(filename string) (CardTemplate, error) {
+	tmpl := DefaultCardTemplate
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return tmpl, err
+	}
+
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(&tmpl); err != nil {
+		return tmpl, fmt.Errorf("failed to decode card template: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+type CardRenderer struct {
+	tmpl       CardTemplate
+	background color.Color
+	foreground color.Color
+	accent     color.Color
+	titleFace  font.Face
+	textFace   font.Face
+	roomPIN    *RoomPIN
+}
+
+// cjkFontPatterns are where systems commonly install Noto Sans CJK or another
+// font with CJK glyphs, in order of preference.
+var cjkFontPatterns = []string{
+	"/usr/share/fonts/*/NotoSansCJK*-Bold.*",
+	"/usr/share/fonts/*/*/NotoSansCJK*-Bold.*",
+	"/usr/local/share/fonts/*/NotoSansCJK*-Bold.*",
+	"/run/current-system/sw/share/X11/fonts/NotoSansCJK*-Bold.*",
+	"/usr/share/fonts/*/NotoSansCJK*.*",
+	"/usr/share/fonts/*/*/NotoSansCJK*.*",
+	"/System/Library/Fonts/ヒラギノ角ゴシック W6.ttc",
+}
+
+// FindCJKFont returns the path of an installed font with CJK glyphs.
+func FindCJKFont() (string, bool) {
+	for _, pattern := range cjkFontPatterns {
+		if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+			return matches[0], true
+		}
+	}
+	return "", false
+}
+
+// NewCardRenderer creates a renderer using the given TrueType or OpenType font,
+// which may be a collection. The Go font is used if fontData is nil, but it has
+// no CJK glyphs.
+func NewCardRenderer(tmpl CardTemplate, fontData []byte) (*CardRenderer, error) {
+	if fontData == nil {
+		fontData = gobold.TTF
+	}
+
+	f, err := opentype.Parse(fontData)
+	if err != nil {
+		collection, collectionErr := opentype.ParseCollection(fontData)
+		if collectionErr != nil {
+			return nil, fmt.Errorf("failed to parse font: %w", err)
+		}
+		if f, err = collection.Font(0); err != nil {
+			return nil, fmt.Errorf("failed to parse font: %w", err)
+		}
+	}
+
+	r := &CardRenderer{tmpl: tmpl}
+
+	for _, c := range []struct {
+		hex string
+		dst *color.Color
+	}{
+		{tmpl.Background, &r.background},
+		{tmpl.Foreground, &r.foreground},
+		{tmpl.Accent, &r.accent},
+	} {
+		if *c.dst, err = parseHexColor(c.hex); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range []struct {
+		size float64
+		dst  *font.Face
+	}{
+		{tmpl.TitleSize, &r.titleFace},
+		{tmpl.TextSize, &r.textFace},
+	} {
+		*c.dst, err = opentype.NewFace(f, &opentype.FaceOptions{Size: c.size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create font face: %w", err)
+		}
+	}
+
+	return r, nil
+}
+
+// SetRoomPIN makes the card show the code guests join with.
+func (r *CardRenderer) SetRoomPIN(pin *RoomPIN) {
+	r.roomPIN = pin
+}
+
+func parseHexColor(s string) (color.Color, error) {
+	var c color.RGBA
+	c.A = 0xff
+
+	if _, err := fmt.Sscanf(s, "#%02x%02x%02x", &c.R, &c.G, &c.B); err != nil {
+		return nil, fmt.Errorf("invalid color %q", s)
+	}
+
+	return c, nil
+}
+
+// WritePNG renders the card for a song and writes it to a file.
+func (r *CardRenderer) WritePNG(ctx context.Context, filename string, song Song, upNext []Song) error {
+	img := r.Render(ctx, song, upNext)
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+	return png.Encode(file, img)
+}
+
+// Render draws the card for a song. Images that cannot be fetched are left out.
+func (r *CardRenderer) Render(ctx context.Context, song Song, upNext []Song) *image.RGBA {
+	t := r.tmpl
+	img := image.NewRGBA(image.Rect(0, 0, t.Width, t.Height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(r.background), image.Point{}, draw.Src)
+
+	textLeft := t.Padding
+	y := t.Padding
+
+	if t.ShowThumbnail && song.Thumbnail != "" {
+		thumbWidth := (t.Width - 3*t.Padding) * 2 / 5
+		thumbRect := image.Rect(t.Padding, t.Padding, t.Padding+thumbWidth, t.Padding+thumbWidth*9/16)
+		if thumb, err := fetchImage(ctx, song.Thumbnail); err == nil {
+			draw.CatmullRom.Scale(img, thumbRect, thumb, thumb.Bounds(), draw.Over, nil)
+			textLeft = thumbRect.Max.X + t.Padding
+		}
+	}
+
+	textWidth := t.Width - textLeft - t.Padding
+	y += r.drawLines(img, r.textFace, r.accent, textLeft, y, []string{"Now playing"})
+	titleLines := wrapText(r.titleFace, song.Title, textWidth)
+	if len(titleLines) > 4 {
+		titleLines = append(titleLines[:3], truncateText(r.titleFace, titleLines[3]+"…", textWidth))
+	}
+	y += r.drawLines(img, r.titleFace, r.foreground, textLeft, y, titleLines)
+	y += t.Padding / 4
+
+	requesterLeft := textLeft
+	lineHeight := r.textFace.Metrics().Height.Ceil()
+
+	if t.ShowAvatar {
+		size := lineHeight * 2
+		if avatar, err := fetchImage(ctx, song.Requester.avatarURL(128)); err == nil {
+			avatarRect := image.Rect(textLeft, y, textLeft+size, y+size)
+			draw.CatmullRom.Scale(img, avatarRect, avatar, avatar.Bounds(), draw.Over, &draw.Options{
+				DstMask:  &circle{center: image.Pt(textLeft+size/2, y+size/2), radius: size / 2},
+				DstMaskP: image.Point{},
+			})
+			requesterLeft += size + t.Padding/4
+		}
+	}
+
+	r.drawLines(img, r.textFace, r.foreground, requesterLeft, y+lineHeight/2, []string{"Requested by " + song.Requester.Name})
+
+	upNextWidth := t.Width - 2*t.Padding
+
+	if t.ShowJoinCode && r.roomPIN != nil {
+		size := lineHeight * 5
+		qrRect := image.Rect(t.Width-t.Padding-size, t.Height-t.Padding-size, t.Width-t.Padding, t.Height-t.Padding)
+		if qr, err := r.roomPIN.QRCode(size); err == nil {
+			draw.Draw(img, qrRect, qr, image.Point{}, draw.Src)
+			r.drawLines(img, r.textFace, r.foreground, qrRect.Min.X, qrRect.Min.Y-2*lineHeight, []string{"Join with PIN"})
+			r.drawLines(img, r.textFace, r.accent, qrRect.Min.X, qrRect.Min.Y-lineHeight, []string{r.roomPIN.PIN()})
+			upNextWidth -= size + t.Padding
+		}
+	}
+
+	if t.UpNextCount > 0 && len(upNext) > 0 {
+		upNext = upNext[:min(len(upNext), t.UpNextCount)]
+		lines := make([]string, 0, len(upNext)+1)
+		lines = append(lines, "Up next")
+		for i, s := range upNext {
+			lines = append(lines, truncateText(r.textFace, fmt.Sprintf("%d. %s (%s)", i+1, s.Title, s.Requester.Name), upNextWidth))
+		}
+
+		y = t.Height - t.Padding - len(lines)*lineHeight
+		r.drawLines(img, r.textFace, r.accent, t.Padding, y, lines[:1])
+		r.drawLines(img, r.textFace, r.foreground, t.Padding, y+lineHeight, lines[1:])
+	}
+
+	return img
+}
+
+// drawLines draws lines of text with their top at y and returns the height used.
+func (r *CardRenderer) drawLines(img draw.Image, face font.Face, c color.Color, x, y int, lines []string) int {
+	metrics := face.Metrics()
+	d := &font.Drawer{Dst: img, Src: image.NewUniform(c), Face: face}
+
+	for i, line := range lines {
+		d.Dot = fixed.P(x, y+metrics.Ascent.Ceil()+i*metrics.Height.Ceil())
+		d.DrawString(line)
+	}
+
+	return len(lines) * metrics.Height.Ceil()
+}
+
+type circle struct {
+	center image.Point
+	radius int
+}
+
+func (c *circle) ColorModel() color.Model { return color.AlphaModel }
+func (c *circle) Bounds() image.Rectangle {
+	return image.Rect(c.center.X-c.radius, c.center.Y-c.radius, c.center.X+c.radius, c.center.Y+c.radius)
+}
+func (c *circle) At(x, y int) color.Color {
+	dx, dy := x-c.center.X, y-c.center.Y
+	if dx*dx+dy*dy <= c.radius*c.radius {
+		return color.Alpha{A: 0xff}
+	}
+	return color.Alpha{}
+}
+
+const (
+	// maxImageBytes and maxImagePixels limit the thumbnails and avatars drawn
+	// on the card, so a huge image cannot use up memory.
+	maxImageBytes  = 10 << 20
+	maxImagePixels = 4096 * 4096
+)
+
+// publicAddress refuses connections to loopback, private and link-local
+// addresses, so image URLs cannot reach the server's own network. It checks
+// the address actually dialed, which covers redirects and DNS answers too.
+func publicAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("refusing to fetch image from %s", host)
+	}
+
+	return nil
+}
+
+func checkImageURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid image URL %q", u)
+	}
+	return nil
+}
+
+// imageClient fetches images from public http(s) URLs only.
+var imageClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: publicAddress}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		return checkImageURL(req.URL)
+	},
+}
+
+func fetchImage(ctx context.Context, imageURL string) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkImageURL(req.URL); err != nil {
+		return nil, err
+	}
+
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching image: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxImageBytes {
+		return nil, fmt.Errorf("image is larger than %d bytes", maxImageBytes)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Width*config.Height > maxImagePixels {
+		return nil, fmt.Errorf("image of %dx%d is too large", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) ||
+		(r >= 0x3000 && r <= 0x303f) || (r >= 0xff00 && r <= 0xffef)
+}
+
+// noLineStart contains characters that must not begin a line in Japanese text.
+const noLineStart = "、。，．・：；？！ー」』）］｝〉》】〕ぁぃぅぇぉっゃゅょゎァィゥェォッャュョヮヵヶ,.!?)]}'\""
+
+// splitBreakable splits text into the smallest units a line may break between:
+// words and spaces for alphabetic scripts, and single characters for CJK.
+// Characters that must not start a line stay attached to the preceding unit.
+func splitBreakable(text string) []string {
+	units := make([]string, 0)
+	word := &strings.Builder{}
+
+	flush := func() {
+		if word.Len() > 0 {
+			units = append(units, word.String())
+			word.Reset()
+		}
+	}
+
+	for _, r := range text {
+		switch {
+		case strings.ContainsRune(noLineStart, r) && (word.Len() > 0 || len(units) > 0):
+			if word.Len() == 0 {
+				units[len(units)-1] += string(r)
+			} else {
+				word.WriteRune(r)
+			}
+		case unicode.IsSpace(r):
+			flush()
+			units = append(units, " ")
+		case isCJK(r):
+			flush()
+			units = append(units, string(r))
+		default:
+			word.WriteRune(r)
+		}
+	}
+
+	flush()
+	return units
+}
+
+// wrapText breaks text into lines no wider than maxWidth pixels.
+func wrapText(face font.Face, text string, maxWidth int) []string {
+	max := fixed.I(maxWidth)
+	lines := make([]string, 0)
+	line := ""
+
+	for _, unit := range splitBreakable(text) {
+		if line == "" && unit == " " {
+			continue
+		}
+
+		if font.MeasureString(face, line+unit) <= max || line == "" {
+			line += unit
+			continue
+		}
+
+		lines = append(lines, strings.TrimRight(line, " "))
+		line = strings.TrimLeft(unit, " ")
+	}
+
+	if line != "" {
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+
+	return lines
+}
+
+// truncateText shortens text with an ellipsis so it is no wider than maxWidth pixels.
+func truncateText(face font.Face, text string, maxWidth int) string {
+	if font.MeasureString(face, text) <= fixed.I(maxWidth) {
+		return text
+	}
+
+	runes := []rune(text)
+	for len(runes) > 0 && font.MeasureString(face, string(runes)+"…") > fixed.I(maxWidth) {
+		runes = runes[:len(runes)-1]
+	}
+
+	return string(runes) + "…"
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.ngrok.com/ngrok"
+	"golang.ngrok.com/ngrok/config"
+)
+
+// listen opens the listener selected by the flags: ngrok if a domain is
+// given, a Unix socket if a path is given, and TCP otherwise. TLS is layered
+// on top of TCP and Unix listeners if requested.
+func listen(ctx context.Context) (net.Listener, error) {
+	var (
+		listener net.Listener
+		err      error
+	)
+
+	switch {
+	case *ngrokDomain != "":
+		return ngrok.Listen(ctx,
+			config.HTTPEndpoint(
+				config.WithDomain(*ngrokDomain),
+			),
+			ngrok.WithAuthtoken(*ngrokToken),
+		)
+	case *unixSocket != "":
+		// remove a socket left behind by a previous run
+		if err := os.Remove(*unixSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		listener, err = net.Listen("unix", *unixSocket)
+	default:
+		listener, err = net.Listen("tcp", *listenAddr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	return listener, nil
+}
+
+func loadTLSConfig() (*tls.Config, error) {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+
+	switch {
+	case *tlsCert != "" || *tlsKey != "":
+		cert, err = tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	case *tlsSelfSigned:
+		cert, err = selfSignedCertificate()
+	default:
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// selfSignedCertificate generates a certificate for localhost and the host of
+// the public URL, valid for a year.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"mpvkaraoke"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if u, err := url.Parse(*publicURL); err == nil && u.Hostname() != "" {
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, u.Hostname())
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
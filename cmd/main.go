@@ -11,77 +11,130 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/NYTimes/gziphandler"
 	"github.com/gorilla/sessions"
 	"github.com/wader/goutubedl"
 	"github.com/xoltia/mpvwebkaraoke"
 	"github.com/xoltia/mpvwebkaraoke/style"
-	"golang.ngrok.com/ngrok"
-	"golang.ngrok.com/ngrok/config"
 	"golang.org/x/oauth2"
 )
 
 var (
-	dbPath         = flag.String("db", "karaoke.sqlite", "path to sqlite database")
-	cachePath      = flag.String("cache", "vidcache", "path to video cache")
-	disableCache   = flag.Bool("disable-cache", false, "disable video cache")
-	disablePersist = flag.Bool("disable-persist", false, "disable queue persistence")
-	ytdlPath       = flag.String("ytdl", "yt-dlp", "path to youtube-dl")
-	ytdlFilter     = flag.String("ytdl-filter", "bestvideo[ext=mp4][height<=1080]+bestaudio/best", "youtube-dl filter")
-	maxUserQueue   = flag.Int("max-queue", 1, "maximum number of songs a user can queue")
-	noCompression  = flag.Bool("no-compression", false, "disable gzip compression")
-	sessionSecret  = flag.String("session-secret", "secret", "session secret")
-	sessionEncrypt = flag.Bool("session-encrypt", false, "encrypt session data")
-	clientID       = flag.String("client-id", "", "discord client ID (required)")
-	clientSecret   = flag.String("client-secret", "", "discord client secret (required)")
-	guildID        = flag.String("guild-id", "", "discord guild ID (required)")
-	adminRole      = flag.String("admin-role", "", "discord admin role")
-	ngrokDomain    = flag.String("ngrok-domain", "", "ngrok domain (required)")
-	ngrokToken     = flag.String("ngrok-token", "", "ngrok authtoken (required)")
+	dbPath          = flag.String("db", "karaoke.sqlite", "path to sqlite database")
+	cachePath       = flag.String("cache", "vidcache", "path to video cache")
+	disableCache    = flag.Bool("disable-cache", false, "disable video cache")
+	disablePersist  = flag.Bool("disable-persist", false, "disable queue persistence")
+	ytdlPath        = flag.String("ytdl", "yt-dlp", "path to youtube-dl")
+	ytdlFilter      = flag.String("ytdl-filter", "bestvideo[ext=mp4][height<=1080]+bestaudio/best", "youtube-dl filter")
+	maxUserQueue    = flag.Int("max-queue", 1, "maximum number of songs a user can queue")
+	maxQueueTime    = flag.Duration("max-queue-duration", 0, "maximum total duration a user can queue, 0 for no limit")
+	maxPerHour      = flag.Int("max-per-hour", 0, "maximum number of songs a user can request per hour, 0 for no limit")
+	previewLimit    = flag.String("preview-limit", "10/1m", "how often a user can preview songs, as count/interval, 0 for no limit")
+	previewGlobal   = flag.String("preview-global-limit", "60/1m", "how often everyone together can preview songs")
+	requestLimit    = flag.String("request-limit", "5/1m", "how often a user can submit songs")
+	requestGlobal   = flag.String("request-global-limit", "30/1m", "how often everyone together can submit songs")
+	sseLimit        = flag.String("sse-limit", "30/1m", "how often a user can open event streams")
+	sseGlobal       = flag.String("sse-global-limit", "0", "how often everyone together can open event streams")
+	loginLimit      = flag.String("login-limit", "5/1m", "how often an IP address can try to log in, against guessing PINs and passwords")
+	loginGlobal     = flag.String("login-global-limit", "0", "how often everyone together can try to log in")
+	noCompression   = flag.Bool("no-compression", false, "disable gzip compression")
+	sessionSecret   = flag.String("session-secret", "secret", "session secret")
+	sessionEncrypt  = flag.Bool("session-encrypt", false, "encrypt session data")
+	sessionSameSite = flag.String("session-same-site", "lax", "SameSite attribute of the session cookie: lax, strict or none")
+	sessionMaxAge   = flag.Duration("session-max-age", 30*24*time.Hour, "how long logins last, 0 for forever")
+	sessionRefresh  = flag.Duration("session-refresh", 15*time.Minute, "how often to check discord and OIDC users again, 0 to only check on admin actions")
+	authProviders   = flag.String("auth", "discord", "comma separated login methods: discord, oidc, pin and password")
+	clientID        = flag.String("client-id", "", "discord client ID (required with discord login)")
+	clientSecret    = flag.String("client-secret", "", "discord client secret (required with discord login)")
+	guildID         = flag.String("guild-id", "", "discord guild ID (required with discord login)")
+	botToken        = flag.String("discord-bot-token", "", "discord bot token, enables /karaoke commands")
+	botPublicKey    = flag.String("discord-public-key", "", "discord application public key (required with the bot)")
+	botChannel      = flag.String("discord-announce-channel", "", "discord channel ID to announce singers in")
+	discordAPIURL   = flag.String("discord-api-url", "https://discord.com/api/v10", "discord API URL used by the bot")
+	adminRole       = flag.String("admin-role", "", "discord admin role, given every permission")
+	rolePerms       = flag.String("role-permissions", "", "permissions of discord roles and OIDC groups, as role=permission,permission;role=permission")
+	memberPerms     = flag.String("member-permissions", "request,skip-own", "permissions of every discord and OIDC user")
+	guestPerms      = flag.String("guest-permissions", "request,skip-own", "permissions of guests joining with the room PIN")
+	oidcIssuer      = flag.String("oidc-issuer", "", "OpenID Connect issuer URL (required with oidc login)")
+	oidcClientID    = flag.String("oidc-client-id", "", "OpenID Connect client ID (required with oidc login)")
+	oidcSecret      = flag.String("oidc-client-secret", "", "OpenID Connect client secret")
+	oidcScopes      = flag.String("oidc-scopes", "", "comma separated OpenID Connect scopes to request besides openid, offline_access and profile")
+	oidcGroups      = flag.String("oidc-groups-claim", "groups", "ID token or userinfo claim listing the user's groups")
+	oidcAdminGroup  = flag.String("oidc-admin-group", "", "OpenID Connect group whose members are admins")
+	roomPIN         = flag.String("room-pin", "", "fixed PIN guests enter to join, a rotating random PIN is used if empty")
+	roomPINLength   = flag.Int("room-pin-length", 4, "number of digits in random room PINs")
+	roomPINRotate   = flag.Duration("room-pin-rotate", 15*time.Minute, "how often to replace the random room PIN, 0 to keep it")
+	adminPassword   = flag.String("admin-password", "", "password of the local admin (required with password login)")
+	ngrokDomain     = flag.String("ngrok-domain", "", "ngrok domain, listen through ngrok if set")
+	ngrokToken      = flag.String("ngrok-token", "", "ngrok authtoken (required with ngrok)")
+	listenAddr      = flag.String("listen", ":8080", "address to listen on when not using ngrok or a unix socket")
+	unixSocket      = flag.String("unix-socket", "", "path of a unix socket to listen on, for reverse proxies")
+	tlsCert         = flag.String("tls-cert", "", "path to a TLS certificate")
+	tlsKey          = flag.String("tls-key", "", "path to a TLS private key")
+	tlsSelfSigned   = flag.Bool("tls-self-signed", false, "serve TLS with a certificate generated at startup")
+	publicURL       = flag.String("public-url", "", "URL the server is reached at (required without ngrok)")
+	subLangs        = flag.String("sub-lang", "ja,ja-Latn,en", "comma separated preferred subtitle languages")
+	vocalFilter     = flag.String("vocal-filter", "lavfi=[pan=stereo|c0=c0-c1|c1=c1-c0]", "mpv audio filter used to reduce vocals")
+	cardFont        = flag.String("card-font", "", "path to a TrueType or OpenType font for the intermission card, an installed Noto Sans CJK is used if empty")
+	cardTemplate    = flag.String("card-template", "", "path to a JSON intermission card template")
+	readyTimeout    = flag.Duration("ready-timeout", 0, "how long to wait for singers to confirm they are ready, 0 to not wait")
+	readyAction     = flag.String("ready-action", "move-down", "what to do when a singer is not ready in time: play, skip or move-down, which skips songs moved down twice already")
+	overlayToken    = flag.String("overlay-token", "", "token in the URL of the /overlay page for streaming, the overlay is off if empty")
+	webhooksFile    = flag.String("webhooks", "", "path to a JSON file of webhooks to send queue and playback events to")
+	loudnessTarget  = flag.Float64("loudness-target", -16, "target integrated loudness of cached songs in LUFS, 0 to disable")
 )
 
-// wraps with newlines if text is too long
-func wrapLongText(text string, length int) string {
-	chars := []rune(text)
+// subtitleURLTimeout is how long to look for the subtitles of a song that were
+// not cached before playing it without them.
+const subtitleURLTimeout = 30 * time.Second
 
-	if len(chars) >= length {
-		wrapped := string(chars[:length]) + "\n"
-		wrapped += wrapLongText(string(chars[length:]), length)
-		return wrapped
+// subtitleFile returns the cached subtitles of a song, or their URL if they were
+// not cached.
+func subtitleFile(song mpvwebkaraoke.Song, cache mpvwebkaraoke.OnceCache) (string, bool) {
+	if song.Subtitle.Language == "" {
+		return "", false
 	}
 
-	return text
-}
+	if subFile, ok := cache.GetSubtitles(song.URL, song.Subtitle); ok {
+		return subFile, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), subtitleURLTimeout)
+	defer cancel()
 
-func writePreviewFrame(filename, message string) error {
-	cmd := exec.Command(
-		"convert",
-		"-size", "1920x1080",
-		"xc:#ffffff",
-		"-font", "Noto-Sans-CJK-JP-Bold",
-		"-pointsize", "50",
-		"-fill", "black",
-		"-draw", fmt.Sprintf("text 150,150 '%s'", strings.ReplaceAll(message, "'", "\\'")),
-		filename,
-	)
-
-	return cmd.Run()
+	subURL, err := mpvwebkaraoke.SubtitleURL(ctx, song.URL, song.Subtitle)
+	if err != nil {
+		log.Println("error getting subtitles:", err)
+		return "", false
+	}
+
+	return subURL, true
 }
 
-func loopMPV(queue *mpvwebkaraoke.Queue, cache mpvwebkaraoke.OnceCache) {
+func loopMPV(queue *mpvwebkaraoke.Queue, readiness *mpvwebkaraoke.Readiness, player *mpvwebkaraoke.Player, cache mpvwebkaraoke.OnceCache, lyrics *mpvwebkaraoke.LyricsStore, card *mpvwebkaraoke.CardRenderer) {
 	for {
 		song := queue.Dequeue()
-		log.Println("playing", song.Title)
 
-		msg := fmt.Sprintf("Now playing:\n%s", wrapLongText(song.Title, 25))
-		msg += "\n\n"
-		msg += fmt.Sprintf("Requested by:\n%s", song.Requester.Name)
+		switch readiness.Await(song) {
+		case mpvwebkaraoke.ReadinessSkip:
+			log.Println("skipping", song.Title, "before playing it")
+			clearSong(song, cache, lyrics)
+			continue
+		case mpvwebkaraoke.ReadinessMoveDown:
+			log.Println("moving down", song.Title, "as the singer is not ready")
+			queue.Requeue(song, 1)
+			continue
+		}
+
+		log.Println("playing", song.Title)
 
 		previewFileName := path.Join(os.TempDir(), "preview_frame.png")
 
-		if err := writePreviewFrame(previewFileName, msg); err != nil {
+		if err := card.WritePNG(context.Background(), previewFileName, song, queue.List()); err != nil {
 			log.Println("error writing preview frame:", err)
 		}
 
@@ -91,15 +144,16 @@ func loopMPV(queue *mpvwebkaraoke.Queue, cache mpvwebkaraoke.OnceCache) {
 			videoFileName = song.URL
 		}
 
-		cmd := exec.Command(
-			"mpv",
-			"--pause=yes",
-			"--fs",
-			previewFileName,
-			videoFileName,
-		)
+		args := []string{"--pause=yes", "--fs", previewFileName}
+
+		if subFile, ok := subtitleFile(song, cache); ok {
+			// per-file options so the subtitles are not shown over the preview frame
+			args = append(args, "--{", "--sub-file="+subFile, videoFileName, "--}")
+		} else {
+			args = append(args, videoFileName)
+		}
 
-		if err := cmd.Run(); err != nil {
+		if err := player.Play(song, cache.GetLoudness(song.URL), args); err != nil {
 			log.Println("error playing song:", err)
 			if exitError, ok := err.(*exec.ExitError); ok {
 				stderr := string(exitError.Stderr)
@@ -107,12 +161,18 @@ func loopMPV(queue *mpvwebkaraoke.Queue, cache mpvwebkaraoke.OnceCache) {
 			}
 		}
 
-		if err := cache.Clear(song.URL); err != nil {
-			log.Println("error clearing cache:", err)
-		}
+		clearSong(song, cache, lyrics)
 	}
 }
 
+func clearSong(song mpvwebkaraoke.Song, cache mpvwebkaraoke.OnceCache, lyrics *mpvwebkaraoke.LyricsStore) {
+	if err := cache.Clear(song.URL); err != nil {
+		log.Println("error clearing cache:", err)
+	}
+
+	lyrics.Clear(song.ID)
+}
+
 func saveKey(key []byte) error {
 	file, err := os.Create("sessions.key")
 	if err != nil {
@@ -145,25 +205,238 @@ func loadEncryptionKey() ([]byte, error) {
 	return key, nil
 }
 
+func loadCardRenderer() *mpvwebkaraoke.CardRenderer {
+	tmpl := mpvwebkaraoke.DefaultCardTemplate
+	if *cardTemplate != "" {
+		var err error
+		tmpl, err = mpvwebkaraoke.LoadCardTemplate(*cardTemplate)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fontPath := *cardFont
+	if fontPath == "" {
+		var ok bool
+		if fontPath, ok = mpvwebkaraoke.FindCJKFont(); !ok {
+			log.Println("warning: no CJK font found, Japanese, Chinese and Korean titles will not show on the intermission card without --card-font")
+		}
+	}
+
+	var fontData []byte
+	if fontPath != "" {
+		var err error
+		fontData, err = os.ReadFile(fontPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	card, err := mpvwebkaraoke.NewCardRenderer(tmpl, fontData)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return card
+}
+
+// loadPermissions parses the permission flags. The admin role and group get
+// every permission.
+func loadPermissions() (roles mpvwebkaraoke.RolePermissions, members, guests mpvwebkaraoke.Permissions) {
+	roles, err := mpvwebkaraoke.ParseRolePermissions(*rolePerms)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, admin := range []string{*adminRole, *oidcAdminGroup} {
+		if admin != "" {
+			roles[admin] = mpvwebkaraoke.AllPermissions
+		}
+	}
+
+	if members, err = mpvwebkaraoke.ParsePermissions(*memberPerms); err != nil {
+		log.Fatal(err)
+	}
+
+	if guests, err = mpvwebkaraoke.ParsePermissions(*guestPerms); err != nil {
+		log.Fatal(err)
+	}
+
+	return
+}
+
+func loadAuthProviders(pin *mpvwebkaraoke.RoomPIN) []mpvwebkaraoke.AuthProvider {
+	baseURL := strings.TrimSuffix(*publicURL, "/")
+	providers := make([]mpvwebkaraoke.AuthProvider, 0)
+	roles, members, guests := loadPermissions()
+
+	for _, provider := range strings.Split(*authProviders, ",") {
+		switch provider {
+		case "discord":
+			providers = append(providers, mpvwebkaraoke.NewDiscordProvider(&oauth2.Config{
+				ClientID:     *clientID,
+				ClientSecret: *clientSecret,
+				// kept for applications registered before other login methods
+				RedirectURL: baseURL + "/auth/callback",
+				Scopes:      []string{"identify", "guilds.members.read"},
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://discord.com/api/oauth2/authorize",
+					TokenURL: "https://discord.com/api/oauth2/token",
+				},
+			}, *guildID, roles, members))
+		case "oidc":
+			var scopes []string
+			if *oidcScopes != "" {
+				scopes = strings.Split(*oidcScopes, ",")
+			}
+
+			oidcProvider, err := mpvwebkaraoke.NewOIDCProvider(context.Background(), mpvwebkaraoke.OIDCConfig{
+				Issuer:       *oidcIssuer,
+				ClientID:     *oidcClientID,
+				ClientSecret: *oidcSecret,
+				RedirectURL:  baseURL + "/auth/oidc/callback",
+				Scopes:       scopes,
+				GroupsClaim:  *oidcGroups,
+				Groups:       roles,
+				Permissions:  members,
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			providers = append(providers, oidcProvider)
+		case "pin":
+			providers = append(providers, mpvwebkaraoke.NewPINProvider(pin, guests))
+		case "password":
+			providers = append(providers, mpvwebkaraoke.NewPasswordProvider(*adminPassword))
+		}
+	}
+
+	return providers
+}
+
+// loadRateLimiter creates a limiter from a per-user and a global limit flag.
+func loadRateLimiter(perUser, global string) *mpvwebkaraoke.RateLimiter {
+	perUserLimit, err := mpvwebkaraoke.ParseRateLimit(perUser)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	globalLimit, err := mpvwebkaraoke.ParseRateLimit(global)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return mpvwebkaraoke.NewRateLimiter(perUserLimit, globalLimit)
+}
+
+// parseSameSite parses the session-same-site flag.
+func parseSameSite(s string) http.SameSite {
+	switch s {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		// the cookie is not sent on the redirect back from discord or OIDC
+		providers := strings.Split(*authProviders, ",")
+		if slices.Contains(providers, "discord") || slices.Contains(providers, "oidc") {
+			log.Println("warning: strict SameSite cookies break discord and OIDC logins")
+		}
+		return http.SameSiteStrictMode
+	case "none":
+		if !strings.HasPrefix(*publicURL, "https://") {
+			log.Fatal("SameSite none cookies require a https public URL")
+		}
+		return http.SameSiteNoneMode
+	default:
+		log.Fatalf("unknown SameSite mode %q", s)
+		return 0
+	}
+}
+
+// loadDiscordBot creates the Discord bot, or returns nil if it is not enabled.
+func loadDiscordBot(queueHandler *mpvwebkaraoke.QueueHandler, requests *mpvwebkaraoke.RateLimiter) *mpvwebkaraoke.DiscordBot {
+	if *botToken == "" {
+		return nil
+	}
+
+	publicKey, err := mpvwebkaraoke.ParseDiscordPublicKey(*botPublicKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	roles, members, _ := loadPermissions()
+	return mpvwebkaraoke.NewDiscordBot(mpvwebkaraoke.DiscordBotConfig{
+		APIURL:        *discordAPIURL,
+		ApplicationID: *clientID,
+		PublicKey:     publicKey,
+		Token:         *botToken,
+		GuildID:       *guildID,
+		ChannelID:     *botChannel,
+		Roles:         roles,
+		Permissions:   members,
+		Requests:      requests,
+	}, queueHandler)
+}
+
 func checkFlags() {
-	if *clientID == "" {
-		log.Fatal("client ID is required")
+	if *botToken != "" && (*clientID == "" || *guildID == "" || *botPublicKey == "") {
+		log.Fatal("client ID, guild ID and public key are required with the discord bot")
 	}
 
-	if *clientSecret == "" {
-		log.Fatal("client secret is required")
+	for _, provider := range strings.Split(*authProviders, ",") {
+		switch provider {
+		case "discord":
+			if *clientID == "" {
+				log.Fatal("client ID is required")
+			}
+
+			if *clientSecret == "" {
+				log.Fatal("client secret is required")
+			}
+
+			if *guildID == "" {
+				log.Fatal("guild ID is required")
+			}
+		case "oidc":
+			if *oidcIssuer == "" || *oidcClientID == "" {
+				log.Fatal("OIDC issuer and client ID are required")
+			}
+		case "pin":
+			if *roomPIN == "" && *roomPINLength < 4 {
+				log.Fatal("room PIN length must be at least 4")
+			}
+		case "password":
+			if *adminPassword == "" {
+				log.Fatal("admin password is required")
+			}
+		default:
+			log.Fatalf("unknown login method %q", provider)
+		}
 	}
 
-	if *guildID == "" {
-		log.Fatal("guild ID is required")
+	if *ngrokDomain != "" {
+		if *ngrokToken == "" {
+			log.Fatal("ngrok authtoken is required")
+		}
+
+		if *unixSocket != "" {
+			log.Fatal("ngrok and unix socket listeners are mutually exclusive")
+		}
+
+		if *tlsCert != "" || *tlsKey != "" || *tlsSelfSigned {
+			log.Fatal("TLS is terminated by ngrok and cannot be configured with it")
+		}
+
+		if *publicURL == "" {
+			*publicURL = "https://" + *ngrokDomain
+		}
 	}
 
-	if *ngrokDomain == "" {
-		log.Fatal("ngrok domain is required")
+	if *publicURL == "" {
+		log.Fatal("public URL is required when not using ngrok")
 	}
 
-	if *ngrokToken == "" {
-		log.Fatal("ngrok authtoken is required")
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("TLS certificate and key must be given together")
 	}
 }
 
@@ -171,7 +444,11 @@ func main() {
 	flag.Parse()
 	checkFlags()
 	goutubedl.Path = *ytdlPath
-	queue := mpvwebkaraoke.NewQueue(*maxUserQueue)
+	queue := mpvwebkaraoke.NewQueue(mpvwebkaraoke.QueueLimits{
+		Songs:    *maxUserQueue,
+		Duration: *maxQueueTime,
+		PerHour:  *maxPerHour,
+	})
 
 	if !*disablePersist {
 		err := queue.Start(context.Background())
@@ -181,8 +458,9 @@ func main() {
 	}
 
 	cacheConfig := mpvwebkaraoke.VideoCacheConfig{
-		CachePath:      *cachePath,
-		DownloadFilter: *ytdlFilter,
+		CachePath:       *cachePath,
+		DownloadFilter:  *ytdlFilter,
+		MeasureLoudness: *loudnessTarget != 0,
 	}
 
 	gob.Register(mpvwebkaraoke.User{})
@@ -208,23 +486,103 @@ func main() {
 		store = sessions.NewCookieStore([]byte(*sessionSecret), key)
 	}
 
-	conf := &oauth2.Config{
-		ClientID:     *clientID,
-		ClientSecret: *clientSecret,
-		RedirectURL:  fmt.Sprintf("https://%s/auth/callback", *ngrokDomain),
-		Scopes:       []string{"identify", "guilds.members.read"},
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://discord.com/api/oauth2/authorize",
-			TokenURL: "https://discord.com/api/oauth2/token",
-		},
+	var pin *mpvwebkaraoke.RoomPIN
+	if slices.Contains(strings.Split(*authProviders, ","), "pin") {
+		pin = mpvwebkaraoke.NewRoomPIN(mpvwebkaraoke.RoomPINConfig{
+			PIN:      *roomPIN,
+			Length:   *roomPINLength,
+			Interval: *roomPINRotate,
+			BaseURL:  *publicURL,
+		})
+		pin.Start(context.Background())
+	}
+
+	if *sessionMaxAge > 0 {
+		store.MaxAge(int(sessionMaxAge.Seconds()))
 	}
 
-	authHandler := mpvwebkaraoke.NewAuthHandler(store, conf, *guildID, *adminRole)
-	queueHandler := mpvwebkaraoke.NewQueueHandler(queue, *maxUserQueue)
+	store.Options.HttpOnly = true
+	store.Options.Secure = strings.HasPrefix(*publicURL, "https://")
+	store.Options.SameSite = parseSameSite(*sessionSameSite)
+
+	logins := mpvwebkaraoke.NewLoginStore(mpvwebkaraoke.LoginStoreConfig{
+		MaxAge:          *sessionMaxAge,
+		RefreshInterval: *sessionRefresh,
+	})
+
+	if !*disablePersist {
+		if err := logins.Start(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	moderationFile, tokensFile := "moderation.gob", "tokens.gob"
+	if *disablePersist {
+		moderationFile, tokensFile = "", ""
+	}
+
+	moderation, err := mpvwebkaraoke.NewModeration(moderationFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tokens, err := mpvwebkaraoke.NewTokenStore(tokensFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authHandler := mpvwebkaraoke.NewAuthHandler(store, logins, moderation, tokens, loadAuthProviders(pin)...)
+	moderationHandler := mpvwebkaraoke.NewModerationHandler(moderation, logins)
+	tokenHandler := mpvwebkaraoke.NewTokenHandler(tokens)
+	guestHandler := mpvwebkaraoke.NewGuestHandler(pin)
+	subtitleLanguages := strings.Split(*subLangs, ",")
+	player := mpvwebkaraoke.NewPlayer(mpvwebkaraoke.PlayerConfig{
+		IPCPath:        path.Join(os.TempDir(), "mpvkaraoke.sock"),
+		VocalFilter:    *vocalFilter,
+		LoudnessTarget: *loudnessTarget,
+	})
+	readinessAction, err := mpvwebkaraoke.ParseReadinessAction(*readyAction)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	readiness := mpvwebkaraoke.NewReadiness(mpvwebkaraoke.ReadinessConfig{
+		Timeout: *readyTimeout,
+		Action:  readinessAction,
+	})
+
+	queueHandler := mpvwebkaraoke.NewQueueHandler(queue, player, readiness, moderation, subtitleLanguages)
+
+	lyricsStore := mpvwebkaraoke.NewLyricsStore(subtitleLanguages)
+	lyricsHandler := mpvwebkaraoke.NewLyricsHandler(queue, lyricsStore)
 
 	queue.OnPush(func(song mpvwebkaraoke.Song) {
-		vidCache.Cache(context.Background(), song.URL)
+		vidCache.Cache(context.Background(), song)
+		lyricsStore.Fetch(context.Background(), song)
 	})
+	queue.OnRevoke(lyricsStore.Clear)
+
+	var webhookConfigs []mpvwebkaraoke.WebhookConfig
+	if *webhooksFile != "" {
+		webhookConfigs, err = mpvwebkaraoke.LoadWebhookConfigs(*webhooksFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	webhooks := mpvwebkaraoke.NewWebhooks(webhookConfigs)
+	webhooks.Start(context.Background())
+	webhookHandler := mpvwebkaraoke.NewWebhookHandler(webhooks)
+
+	queue.OnPush(webhooks.SongEvent(mpvwebkaraoke.WebhookQueuePush))
+	queue.OnRemove(webhooks.RemoveEvent)
+	player.OnStart(webhooks.SongEvent(mpvwebkaraoke.WebhookPlaybackStart))
+	player.OnEnd(webhooks.SongEvent(mpvwebkaraoke.WebhookPlaybackEnd))
+
+	previewLimiter := loadRateLimiter(*previewLimit, *previewGlobal)
+	requestLimiter := loadRateLimiter(*requestLimit, *requestGlobal)
+	sseLimiter := loadRateLimiter(*sseLimit, *sseGlobal)
+	loginLimiter := loadRateLimiter(*loginLimit, *loginGlobal)
 
 	mux := http.NewServeMux()
 
@@ -237,8 +595,11 @@ func main() {
 	})
 
 	mux.HandleFunc("GET /auth", authHandler.HandleIndex)
-	mux.HandleFunc("GET /auth/callback", authHandler.HandleCallback)
-	mux.HandleFunc("GET /auth/logout", authHandler.HandleLogout)
+	mux.HandleFunc("GET /auth/callback", authHandler.HandleCallbackFor("discord"))
+	mux.HandleFunc("POST /auth/logout", authHandler.Wrap(authHandler.HandleLogout))
+	mux.HandleFunc("GET /auth/{provider}", authHandler.HandleLogin)
+	mux.HandleFunc("GET /auth/{provider}/callback", authHandler.HandleCallback)
+	mux.HandleFunc("POST /auth/{provider}/callback", loginLimiter.WrapIP(authHandler.HandleCallback))
 
 	if *noCompression {
 		mux.HandleFunc("GET /style.css", func(w http.ResponseWriter, r *http.Request) {
@@ -248,11 +609,43 @@ func main() {
 		})
 		mux.HandleFunc("GET /queue", authHandler.Wrap(queueHandler.HandleIndex))
 		mux.HandleFunc("GET /queue/request", authHandler.Wrap(queueHandler.HandleSubmissionPage))
-		mux.HandleFunc("POST /queue/preview", authHandler.Wrap(queueHandler.HandlePostPreview))
-		mux.HandleFunc("POST /queue/request", authHandler.Wrap(queueHandler.HandlePostSubmission))
-		mux.HandleFunc("DELETE /queue/revoke/{id}", authHandler.Wrap(queueHandler.HandleRevoke))
+		mux.HandleFunc("POST /queue/preview", authHandler.Wrap(previewLimiter.Wrap(queueHandler.HandlePostPreview)))
+		mux.HandleFunc("POST /queue/request", authHandler.Wrap(requestLimiter.Wrap(queueHandler.HandlePostSubmission)))
+		mux.HandleFunc("DELETE /queue/revoke/{id}", authHandler.WrapSensitive(queueHandler.HandleRevoke))
+		mux.HandleFunc("POST /queue/move/{id}", authHandler.WrapSensitive(queueHandler.HandleMove))
+		mux.HandleFunc("POST /queue/skip/{id}", authHandler.WrapSensitive(queueHandler.HandleSkip))
+		mux.HandleFunc("POST /queue/adjust/{id}", authHandler.WrapSensitive(queueHandler.HandleAdjustPlayback))
 		mux.HandleFunc("GET /queue/current", authHandler.Wrap(queueHandler.HandleCurrentSong))
+		mux.HandleFunc("POST /queue/ready", authHandler.Wrap(queueHandler.HandleReady))
+		mux.HandleFunc("GET /queue/readiness", authHandler.WrapSensitive(queueHandler.HandleReadinessSettings))
+		mux.HandleFunc("POST /queue/readiness", authHandler.WrapSensitive(queueHandler.HandlePostReadinessSettings))
 		mux.HandleFunc("GET /queue/members", authHandler.Wrap(queueHandler.HandleMemberList))
+		mux.HandleFunc("GET /moderation", authHandler.WrapSensitive(moderationHandler.HandleIndex))
+		mux.HandleFunc("POST /moderation/{id}", authHandler.WrapSensitive(moderationHandler.HandlePostAction))
+		mux.HandleFunc("GET /queue/limits", authHandler.WrapSensitive(queueHandler.HandleQueueLimits))
+		mux.HandleFunc("POST /queue/limits", authHandler.WrapSensitive(queueHandler.HandlePostQueueLimits))
+		mux.HandleFunc("POST /queue/limits/user", authHandler.WrapSensitive(queueHandler.HandlePostUserLimits))
+		mux.HandleFunc("DELETE /queue/limits/user/{id}", authHandler.WrapSensitive(queueHandler.HandleDeleteUserLimits))
+		mux.HandleFunc("GET /guests", authHandler.WrapSensitive(guestHandler.HandleIndex))
+		mux.HandleFunc("GET /guests/code", authHandler.WrapSensitive(guestHandler.HandleJoinCode))
+		mux.HandleFunc("POST /guests/rotate", authHandler.WrapSensitive(guestHandler.HandleRotate))
+		mux.HandleFunc("GET /webhooks", authHandler.WrapSensitive(webhookHandler.HandleIndex))
+		mux.HandleFunc("GET /webhooks/deliveries", authHandler.WrapSensitive(webhookHandler.HandleDeliveries))
+		mux.HandleFunc("GET /lyrics", authHandler.Wrap(lyricsHandler.HandleIndex))
+		mux.HandleFunc("GET /lyrics/current", authHandler.Wrap(lyricsHandler.HandleCurrentLyrics))
+		mux.HandleFunc("GET /api/v1/queue", authHandler.Wrap(queueHandler.HandleAPIQueue))
+		mux.HandleFunc("POST /api/v1/queue", authHandler.Wrap(requestLimiter.Wrap(queueHandler.HandleAPISubmission)))
+		mux.HandleFunc("DELETE /api/v1/queue/{id}", authHandler.WrapSensitive(queueHandler.HandleAPIRevoke))
+		mux.HandleFunc("PATCH /api/v1/queue/{id}", authHandler.WrapSensitive(queueHandler.HandleAPIAdjust))
+		mux.HandleFunc("POST /api/v1/queue/{id}/skip", authHandler.WrapSensitive(queueHandler.HandleAPISkip))
+		mux.HandleFunc("GET /api/v1/current", authHandler.Wrap(queueHandler.HandleAPICurrent))
+		mux.HandleFunc("GET /api/v1/history", authHandler.Wrap(queueHandler.HandleAPIHistory))
+		mux.HandleFunc("GET /api/v1/members", authHandler.Wrap(queueHandler.HandleAPIMembers))
+		mux.HandleFunc("GET /api/v1/openapi.json", queueHandler.HandleAPIOpenAPI)
+		mux.HandleFunc("GET /tokens", authHandler.Wrap(tokenHandler.HandleIndex))
+		mux.HandleFunc("GET /tokens/list", authHandler.Wrap(tokenHandler.HandleList))
+		mux.HandleFunc("POST /tokens", authHandler.WrapSensitive(tokenHandler.HandlePostToken))
+		mux.HandleFunc("DELETE /tokens/{id}", authHandler.WrapSensitive(tokenHandler.HandleRevoke))
 		//mux.HandleFunc("GET /sse", authHandler.Wrap(queueHandler.HandleSSE))
 	} else {
 		mux.Handle("GET /style.css", gziphandler.GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -262,28 +655,78 @@ func main() {
 		})))
 		mux.Handle("GET /queue", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandleIndex))))
 		mux.Handle("GET /queue/request", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandleSubmissionPage))))
-		mux.Handle("POST /queue/preview", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandlePostPreview))))
-		mux.Handle("POST /queue/request", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandlePostSubmission))))
-		mux.Handle("DELETE /queue/revoke/{id}", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandleRevoke))))
+		mux.Handle("POST /queue/preview", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(previewLimiter.Wrap(queueHandler.HandlePostPreview)))))
+		mux.Handle("POST /queue/request", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(requestLimiter.Wrap(queueHandler.HandlePostSubmission)))))
+		mux.Handle("DELETE /queue/revoke/{id}", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandleRevoke))))
+		mux.Handle("POST /queue/move/{id}", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandleMove))))
+		mux.Handle("POST /queue/skip/{id}", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandleSkip))))
+		mux.Handle("POST /queue/adjust/{id}", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandleAdjustPlayback))))
 		mux.Handle("GET /queue/current", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandleCurrentSong))))
+		mux.Handle("POST /queue/ready", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandleReady))))
+		mux.Handle("GET /queue/readiness", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandleReadinessSettings))))
+		mux.Handle("POST /queue/readiness", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandlePostReadinessSettings))))
 		mux.Handle("GET /queue/members", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandleMemberList))))
+		mux.Handle("GET /moderation", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(moderationHandler.HandleIndex))))
+		mux.Handle("POST /moderation/{id}", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(moderationHandler.HandlePostAction))))
+		mux.Handle("GET /queue/limits", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandleQueueLimits))))
+		mux.Handle("POST /queue/limits", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandlePostQueueLimits))))
+		mux.Handle("POST /queue/limits/user", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandlePostUserLimits))))
+		mux.Handle("DELETE /queue/limits/user/{id}", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandleDeleteUserLimits))))
+		mux.Handle("GET /guests", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(guestHandler.HandleIndex))))
+		mux.Handle("GET /guests/code", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(guestHandler.HandleJoinCode))))
+		mux.Handle("POST /guests/rotate", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(guestHandler.HandleRotate))))
+		mux.Handle("GET /webhooks", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(webhookHandler.HandleIndex))))
+		mux.Handle("GET /webhooks/deliveries", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(webhookHandler.HandleDeliveries))))
+		mux.Handle("GET /lyrics", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(lyricsHandler.HandleIndex))))
+		mux.Handle("GET /lyrics/current", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(lyricsHandler.HandleCurrentLyrics))))
+		mux.Handle("GET /api/v1/queue", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandleAPIQueue))))
+		mux.Handle("POST /api/v1/queue", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(requestLimiter.Wrap(queueHandler.HandleAPISubmission)))))
+		mux.Handle("DELETE /api/v1/queue/{id}", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandleAPIRevoke))))
+		mux.Handle("PATCH /api/v1/queue/{id}", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandleAPIAdjust))))
+		mux.Handle("POST /api/v1/queue/{id}/skip", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(queueHandler.HandleAPISkip))))
+		mux.Handle("GET /api/v1/current", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandleAPICurrent))))
+		mux.Handle("GET /api/v1/history", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandleAPIHistory))))
+		mux.Handle("GET /api/v1/members", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(queueHandler.HandleAPIMembers))))
+		mux.Handle("GET /api/v1/openapi.json", gziphandler.GzipHandler(http.HandlerFunc(queueHandler.HandleAPIOpenAPI)))
+		mux.Handle("GET /tokens", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(tokenHandler.HandleIndex))))
+		mux.Handle("GET /tokens/list", gziphandler.GzipHandler(http.HandlerFunc(authHandler.Wrap(tokenHandler.HandleList))))
+		mux.Handle("POST /tokens", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(tokenHandler.HandlePostToken))))
+		mux.Handle("DELETE /tokens/{id}", gziphandler.GzipHandler(http.HandlerFunc(authHandler.WrapSensitive(tokenHandler.HandleRevoke))))
+	}
+
+	mux.HandleFunc("GET /sse", authHandler.Wrap(sseLimiter.Wrap(queueHandler.HandleSSE)))
+	mux.HandleFunc("GET /ws", authHandler.Wrap(sseLimiter.Wrap(queueHandler.HandleWebSocket)))
+	mux.HandleFunc("GET /guests/qr.png", authHandler.WrapSensitive(guestHandler.HandleQRCode))
+
+	if *overlayToken != "" {
+		overlayHandler := mpvwebkaraoke.NewOverlayHandler(queueHandler, *overlayToken)
+		mux.HandleFunc("GET /overlay", overlayHandler.HandleIndex)
+		mux.HandleFunc("GET /overlay/events", overlayHandler.HandleEvents)
 	}
 
-	mux.HandleFunc("GET /sse", authHandler.Wrap(queueHandler.HandleSSE))
+	if bot := loadDiscordBot(queueHandler, requestLimiter); bot != nil {
+		mux.HandleFunc("POST /discord/interactions", bot.HandleInteraction)
+		player.OnStart(bot.Announce)
 
-	go loopMPV(queue, vidCache)
+		go func() {
+			if err := bot.RegisterCommands(context.Background()); err != nil {
+				log.Println("error registering discord commands:", err)
+			}
+		}()
+	}
+
+	card := loadCardRenderer()
+	if pin != nil {
+		card.SetRoomPIN(pin)
+	}
 
-	listener, err := ngrok.Listen(context.Background(),
-		config.HTTPEndpoint(
-			config.WithDomain(*ngrokDomain),
-		),
-		ngrok.WithAuthtoken(*ngrokToken),
-	)
+	go loopMPV(queue, readiness, player, vidCache, lyricsStore, card)
 
+	listener, err := listen(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("listening on https://%s\n", listener.Addr())
+	log.Printf("listening on %s, reachable at %s\n", listener.Addr(), *publicURL)
 	http.Serve(listener, mux)
 }
@@ -0,0 +1,64 @@
+package mpvwebkaraoke
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+var csrfKey = "csrf"
+
+// csrfHeader is sent by htmx with every request, see csrfHeaders.
+const csrfHeader = "X-CSRF-Token"
+
+// csrfFormField is used by plain forms that are not submitted by htmx.
+const csrfFormField = "csrf_token"
+
+// sessionCSRFToken returns the CSRF token of a session, creating one if it has
+// none. It reports whether the session needs saving.
+func sessionCSRFToken(session *sessions.Session) (token string, created bool) {
+	if token, ok := session.Values["csrf"].(string); ok && token != "" {
+		return token, false
+	}
+
+	token = newState()
+	session.Values["csrf"] = token
+	return token, true
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// checkCSRF reports whether a request that changes state carries the token
+// of its session.
+func checkCSRF(r *http.Request, token string) bool {
+	if safeMethod(r.Method) {
+		return true
+	}
+
+	sent := r.Header.Get(csrfHeader)
+	if sent == "" {
+		sent = r.PostFormValue(csrfFormField)
+	}
+
+	return sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
+
+func withCSRFToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, csrfKey, token)
+}
+
+func csrfToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfKey).(string)
+	return token
+}
+
+// csrfHeaders is the value of hx-headers that makes htmx send the token.
+func csrfHeaders(ctx context.Context) string {
+	headers, _ := json.Marshal(map[string]string{csrfHeader: csrfToken(ctx)})
+	return string(headers)
+}
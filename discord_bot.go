@@ -0,0 +1,377 @@
+package mpvwebkaraoke
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DiscordBotConfig configures the Discord bot. Discord sends slash commands to
+// the interactions endpoint, signed with the application's public key.
+type DiscordBotConfig struct {
+	// APIURL is the base URL of the Discord API, it can point at a stand-in.
+	APIURL        string
+	ApplicationID string
+	PublicKey     ed25519.PublicKey
+	Token         string
+	GuildID       string
+	// ChannelID is where songs are announced, nothing is if it is empty.
+	ChannelID   string
+	Roles       RolePermissions
+	Permissions Permissions
+	// Requests limits how often members can request songs, it may be nil.
+	Requests *RateLimiter
+}
+
+// DiscordBot lets guild members use the queue with /karaoke commands and
+// announces who is singing.
+type DiscordBot struct {
+	config DiscordBotConfig
+	queue  *QueueHandler
+	client *http.Client
+	lookup func(context.Context, string) (videoInfo, error)
+}
+
+func NewDiscordBot(config DiscordBotConfig, queue *QueueHandler) *DiscordBot {
+	config.APIURL = strings.TrimSuffix(config.APIURL, "/")
+	return &DiscordBot{
+		config: config,
+		queue:  queue,
+		client: &http.Client{Timeout: 10 * time.Second},
+		lookup: getVideoInfo,
+	}
+}
+
+// ParseDiscordPublicKey parses the hex encoded public key shown on the
+// application's page.
+func ParseDiscordPublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid discord public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+const (
+	interactionPing               = 1
+	interactionApplicationCommand = 2
+
+	responsePong                   = 1
+	responseChannelMessage         = 4
+	responseDeferredChannelMessage = 5
+
+	messageFlagEphemeral = 1 << 6
+
+	commandChatInput = 1
+	optionSubCommand = 1
+	optionString     = 3
+)
+
+type interactionOption struct {
+	Name    string              `json:"name"`
+	Value   any                 `json:"value"`
+	Options []interactionOption `json:"options"`
+}
+
+func (o interactionOption) option(name string) (interactionOption, bool) {
+	i := slices.IndexFunc(o.Options, func(o interactionOption) bool { return o.Name == name })
+	if i < 0 {
+		return interactionOption{}, false
+	}
+	return o.Options[i], true
+}
+
+type interaction struct {
+	Type    int               `json:"type"`
+	Token   string            `json:"token"`
+	GuildID string            `json:"guild_id"`
+	Member  *guildMember      `json:"member"`
+	Data    interactionOption `json:"data"`
+}
+
+type discordMessage struct {
+	Content         string `json:"content"`
+	Flags           int    `json:"flags,omitempty"`
+	AllowedMentions struct {
+		Parse []string `json:"parse"`
+	} `json:"allowed_mentions"`
+}
+
+type interactionResponse struct {
+	Type int             `json:"type"`
+	Data *discordMessage `json:"data,omitempty"`
+}
+
+func newMessage(content string, flags int) *discordMessage {
+	// titles and names may contain @everyone, never ping anyone
+	m := &discordMessage{Content: content, Flags: flags}
+	m.AllowedMentions.Parse = []string{}
+	return m
+}
+
+// escapeMarkdown keeps titles and names from being formatted.
+func escapeMarkdown(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "|", `\|`, ">", `\>`).Replace(s)
+}
+
+func (b *DiscordBot) do(ctx context.Context, method, path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, b.config.APIURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bot "+b.config.Token)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("discord responded with %s: %s", resp.Status, message)
+	}
+
+	return nil
+}
+
+// commandOption describes a command or its options when registering it.
+type commandOption struct {
+	Name        string          `json:"name"`
+	Type        int             `json:"type"`
+	Description string          `json:"description"`
+	Required    bool            `json:"required,omitempty"`
+	Options     []commandOption `json:"options,omitempty"`
+}
+
+// RegisterCommands creates the /karaoke command in the guild, replacing any
+// commands the application had there before.
+func (b *DiscordBot) RegisterCommands(ctx context.Context) error {
+	commands := []commandOption{{
+		Name:        "karaoke",
+		Type:        commandChatInput,
+		Description: "Use the karaoke queue",
+		Options: []commandOption{
+			{Name: "request", Type: optionSubCommand, Description: "Request a song", Options: []commandOption{
+				{Name: "url", Type: optionString, Description: "Link to the video", Required: true},
+			}},
+			{Name: "queue", Type: optionSubCommand, Description: "Show the queue"},
+			{Name: "skip", Type: optionSubCommand, Description: "Skip the song that is playing"},
+		},
+	}}
+
+	path := fmt.Sprintf("/applications/%s/guilds/%s/commands", b.config.ApplicationID, b.config.GuildID)
+	return b.do(ctx, http.MethodPut, path, commands)
+}
+
+// Announce posts the song that starts playing to the announcement channel.
+func (b *DiscordBot) Announce(song Song) {
+	if b.config.ChannelID == "" {
+		return
+	}
+
+	content := fmt.Sprintf("Now singing: **%s**, requested by %s",
+		escapeMarkdown(song.Title), escapeMarkdown(song.Requester.Name))
+
+	// announcing must not hold up playback
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := b.do(ctx, http.MethodPost, "/channels/"+b.config.ChannelID+"/messages", newMessage(content, 0)); err != nil {
+			log.Println("error announcing song on discord:", err)
+		}
+	}()
+}
+
+func (b *DiscordBot) verify(r *http.Request, body []byte) bool {
+	signature, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	if err != nil {
+		return false
+	}
+
+	message := append([]byte(r.Header.Get("X-Signature-Timestamp")), body...)
+	return ed25519.Verify(b.config.PublicKey, message, signature)
+}
+
+func respond(w http.ResponseWriter, response interactionResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func reply(w http.ResponseWriter, content string, flags int) {
+	respond(w, interactionResponse{Type: responseChannelMessage, Data: newMessage(content, flags)})
+}
+
+// HandleInteraction runs the slash commands Discord sends.
+func (b *DiscordBot) HandleInteraction(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	if !b.verify(r, body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var i interaction
+	if err := json.Unmarshal(body, &i); err != nil {
+		http.Error(w, "invalid interaction", http.StatusBadRequest)
+		return
+	}
+
+	switch i.Type {
+	case interactionPing:
+		respond(w, interactionResponse{Type: responsePong})
+		return
+	case interactionApplicationCommand:
+	default:
+		http.Error(w, "unsupported interaction", http.StatusBadRequest)
+		return
+	}
+
+	if i.Member == nil || i.GuildID != b.config.GuildID {
+		reply(w, "Karaoke commands only work in the karaoke server.", messageFlagEphemeral)
+		return
+	}
+
+	user := b.queue.moderation.Restrict(i.Member.user(b.config.Roles, b.config.Permissions))
+
+	if i.Data.Name != "karaoke" || len(i.Data.Options) != 1 {
+		reply(w, "Unknown command.", messageFlagEphemeral)
+		return
+	}
+
+	switch sub := i.Data.Options[0]; sub.Name {
+	case "request":
+		url, _ := sub.option("url")
+		songURL, _ := url.Value.(string)
+		b.handleRequest(w, i, user, songURL)
+	case "queue":
+		b.handleQueue(w)
+	case "skip":
+		b.handleSkip(w, user)
+	default:
+		reply(w, "Unknown command.", messageFlagEphemeral)
+	}
+}
+
+func (b *DiscordBot) handleRequest(w http.ResponseWriter, i interaction, user User, songURL string) {
+	if err := b.queue.moderation.CheckRequest(user.ID); err != nil {
+		reply(w, capitalize(err.Error())+".", messageFlagEphemeral)
+		return
+	}
+
+	if !user.Can(PermRequest) {
+		reply(w, "You may not request songs.", messageFlagEphemeral)
+		return
+	}
+
+	if !checkURL(songURL) {
+		reply(w, "That is not a valid link.", messageFlagEphemeral)
+		return
+	}
+
+	if b.config.Requests != nil {
+		if wait := b.config.Requests.Allow(user.ID); wait > 0 {
+			reply(w, fmt.Sprintf("You are going too fast, try again in %s.", wait.Round(time.Second)), messageFlagEphemeral)
+			return
+		}
+	}
+
+	// looking the video up can take longer than Discord waits for a response,
+	// so answer later by editing the deferred response
+	respond(w, interactionResponse{Type: responseDeferredChannelMessage})
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		content := b.request(ctx, user, songURL)
+		path := fmt.Sprintf("/webhooks/%s/%s/messages/@original", b.config.ApplicationID, i.Token)
+		if err := b.do(ctx, http.MethodPatch, path, newMessage(content, 0)); err != nil {
+			log.Println("error answering discord request:", err)
+		}
+	}()
+}
+
+func (b *DiscordBot) request(ctx context.Context, user User, songURL string) string {
+	video, err := b.lookup(ctx, songURL)
+	if err != nil {
+		log.Println("failed to get video info for discord request:", err)
+		return "Could not find that video."
+	}
+
+	song, err := b.queue.queue.Push(Song{
+		Requester: user,
+		Title:     video.title,
+		URL:       songURL,
+		Duration:  video.duration,
+		Speed:     1,
+		Thumbnail: video.thumbnail,
+	})
+	if err != nil {
+		return capitalize(err.Error()) + "."
+	}
+
+	position := slices.IndexFunc(b.queue.queue.List(), func(s Song) bool { return s.ID == song.ID }) + 1
+	return fmt.Sprintf("%s requested **%s**, number %d in the queue.",
+		escapeMarkdown(user.Name), escapeMarkdown(song.Title), position)
+}
+
+func (b *DiscordBot) handleQueue(w http.ResponseWriter) {
+	songs := b.queue.queue.List()
+	if len(songs) == 0 {
+		reply(w, "The queue is empty.", messageFlagEphemeral)
+		return
+	}
+
+	var content strings.Builder
+	for i, s := range songs[:min(len(songs), 10)] {
+		fmt.Fprintf(&content, "%d. **%s**, requested by %s\n", i+1, escapeMarkdown(s.Title), escapeMarkdown(s.Requester.Name))
+	}
+	if len(songs) > 10 {
+		fmt.Fprintf(&content, "and %d more", len(songs)-10)
+	}
+
+	reply(w, content.String(), messageFlagEphemeral)
+}
+
+func (b *DiscordBot) handleSkip(w http.ResponseWriter, user User) {
+	song, ok := b.queue.queue.LastDequeued()
+	if !ok {
+		reply(w, "Nothing is playing.", messageFlagEphemeral)
+		return
+	}
+
+	switch err := b.queue.skip(user, song.ID); {
+	case errors.Is(err, errNotPlaying):
+		reply(w, "Nothing is playing.", messageFlagEphemeral)
+	case errors.Is(err, errUnauthorized):
+		reply(w, "You may not skip this song.", messageFlagEphemeral)
+	case err != nil:
+		log.Println("error skipping song from discord:", err)
+		reply(w, "Could not skip the song.", messageFlagEphemeral)
+	default:
+		reply(w, fmt.Sprintf("%s skipped **%s**.", escapeMarkdown(user.Name), escapeMarkdown(song.Title)), 0)
+	}
+}
@@ -0,0 +1,266 @@
+package mpvwebkaraoke
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// discordCall is a request the bot made to the stand-in Discord API.
+type discordCall struct {
+	method string
+	path   string
+	auth   string
+	body   []byte
+}
+
+type testBot struct {
+	bot   *DiscordBot
+	queue *Queue
+	key   ed25519.PrivateKey
+	calls chan discordCall
+}
+
+func newTestBot(t *testing.T, limits QueueLimits) *testBot {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := make(chan discordCall, 16)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		calls <- discordCall{method: r.Method, path: r.URL.Path, auth: r.Header.Get("Authorization"), body: body}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(api.Close)
+
+	moderation, err := NewModeration("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue := NewQueue(limits)
+	handler := NewQueueHandler(queue, NewPlayer(PlayerConfig{}), NewReadiness(ReadinessConfig{}), moderation, nil)
+
+	bot := NewDiscordBot(DiscordBotConfig{
+		APIURL:        api.URL + "/",
+		ApplicationID: "app",
+		PublicKey:     public,
+		Token:         "secret",
+		GuildID:       "guild",
+		ChannelID:     "channel",
+		Roles:         RolePermissions{},
+		Permissions:   PermRequest | PermSkipOwn,
+	}, handler)
+	bot.lookup = func(ctx context.Context, url string) (videoInfo, error) {
+		return videoInfo{title: "Song *title*", duration: 3 * time.Minute}, nil
+	}
+
+	return &testBot{bot: bot, queue: queue, key: private, calls: calls}
+}
+
+// interact sends an interaction to the bot, signed with key.
+func (tb *testBot) interact(t *testing.T, key ed25519.PrivateKey, i any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := "1700000000"
+	signature := ed25519.Sign(key, append([]byte(timestamp), body...))
+
+	r := httptest.NewRequest(http.MethodPost, "/discord/interactions", bytes.NewReader(body))
+	r.Header.Set("X-Signature-Ed25519", hex.EncodeToString(signature))
+	r.Header.Set("X-Signature-Timestamp", timestamp)
+
+	w := httptest.NewRecorder()
+	tb.bot.HandleInteraction(w, r)
+	return w
+}
+
+func (tb *testBot) call(t *testing.T) discordCall {
+	t.Helper()
+
+	select {
+	case c := <-tb.calls:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("the bot did not call the Discord API")
+		return discordCall{}
+	}
+}
+
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) interactionResponse {
+	t.Helper()
+
+	var response interactionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	return response
+}
+
+func requestInteraction(userID, url string) map[string]any {
+	return map[string]any{
+		"type":     interactionApplicationCommand,
+		"token":    "interaction-token",
+		"guild_id": "guild",
+		"member": map[string]any{
+			"user":  map[string]any{"id": userID, "username": "singer"},
+			"roles": []string{},
+		},
+		"data": map[string]any{
+			"name": "karaoke",
+			"options": []any{map[string]any{
+				"name":    "request",
+				"options": []any{map[string]any{"name": "url", "value": url}},
+			}},
+		},
+	}
+}
+
+func TestDiscordBotPing(t *testing.T) {
+	tb := newTestBot(t, QueueLimits{Songs: 1})
+
+	w := tb.interact(t, tb.key, map[string]any{"type": interactionPing})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+
+	if response := decodeResponse(t, w); response.Type != responsePong {
+		t.Errorf("got response type %d, want pong", response.Type)
+	}
+}
+
+func TestDiscordBotRejectsBadSignature(t *testing.T) {
+	tb := newTestBot(t, QueueLimits{Songs: 1})
+
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := tb.interact(t, otherKey, map[string]any{"type": interactionPing})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want 401", w.Code)
+	}
+}
+
+func TestDiscordBotRequest(t *testing.T) {
+	tb := newTestBot(t, QueueLimits{Songs: 1})
+
+	w := tb.interact(t, tb.key, requestInteraction("1", "https://example.com/video"))
+	if response := decodeResponse(t, w); response.Type != responseDeferredChannelMessage {
+		t.Fatalf("got response type %d, want a deferred message", response.Type)
+	}
+
+	c := tb.call(t)
+	if c.method != http.MethodPatch || c.path != "/webhooks/app/interaction-token/messages/@original" {
+		t.Fatalf("got %s %s, want the deferred response to be edited", c.method, c.path)
+	}
+
+	var message discordMessage
+	if err := json.Unmarshal(c.body, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(message.Content, `Song \*title\*`) {
+		t.Errorf("got message %q, want the escaped title", message.Content)
+	}
+
+	if songs := tb.queue.List(); len(songs) != 1 || songs[0].Requester.ID != "1" {
+		t.Errorf("got queue %v, want the requested song", songs)
+	}
+}
+
+func TestDiscordBotRequestLimit(t *testing.T) {
+	tb := newTestBot(t, QueueLimits{Songs: 1})
+
+	if _, err := tb.queue.Push(Song{Requester: User{ID: "1"}, Title: "First", URL: "https://example.com/first", Speed: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	tb.interact(t, tb.key, requestInteraction("1", "https://example.com/second"))
+
+	c := tb.call(t)
+	if c.method != http.MethodPatch || c.path != "/webhooks/app/interaction-token/messages/@original" {
+		t.Fatalf("got %s %s, want the deferred response to be edited", c.method, c.path)
+	}
+
+	var message discordMessage
+	if err := json.Unmarshal(c.body, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := capitalize(ErrSongLimit.Error()) + "."; message.Content != want {
+		t.Errorf("got message %q, want %q", message.Content, want)
+	}
+
+	if songs := tb.queue.List(); len(songs) != 1 {
+		t.Errorf("got %d queued songs, want only the first", len(songs))
+	}
+}
+
+func TestDiscordBotRegisterCommands(t *testing.T) {
+	tb := newTestBot(t, QueueLimits{Songs: 1})
+
+	if err := tb.bot.RegisterCommands(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := tb.call(t)
+	if c.method != http.MethodPut || c.path != "/applications/app/guilds/guild/commands" {
+		t.Fatalf("got %s %s, want the guild commands to be replaced", c.method, c.path)
+	}
+
+	if c.auth != "Bot secret" {
+		t.Errorf("got Authorization %q, want the bot token", c.auth)
+	}
+
+	var commands []commandOption
+	if err := json.Unmarshal(c.body, &commands); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(commands) != 1 || commands[0].Name != "karaoke" || len(commands[0].Options) != 3 {
+		t.Errorf("got commands %+v, want /karaoke with three subcommands", commands)
+	}
+}
+
+func TestDiscordBotAnnounceMentionsNobody(t *testing.T) {
+	tb := newTestBot(t, QueueLimits{Songs: 1})
+
+	tb.bot.Announce(Song{Title: "@everyone", Requester: User{ID: "1", Name: "singer"}})
+
+	c := tb.call(t)
+	if c.method != http.MethodPost || c.path != "/channels/channel/messages" {
+		t.Fatalf("got %s %s, want a message in the announcement channel", c.method, c.path)
+	}
+
+	var message struct {
+		AllowedMentions struct {
+			Parse []string `json:"parse"`
+		} `json:"allowed_mentions"`
+	}
+	if err := json.Unmarshal(c.body, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	if message.AllowedMentions.Parse == nil || len(message.AllowedMentions.Parse) != 0 {
+		t.Errorf("got allowed mentions %q in %s, want an empty list", message.AllowedMentions.Parse, c.body)
+	}
+}
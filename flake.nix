@@ -30,7 +30,7 @@
                 gnumake
                 mpv
                 yt-dlp
-                imagemagick
+                ffmpeg
               ];
             };
           }
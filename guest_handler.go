@@ -0,0 +1,89 @@
+package mpvwebkaraoke
+
+import (
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// GuestHandler shows admins the code guests join with. The PIN is nil if
+// guests cannot join.
+type GuestHandler struct {
+	pin *RoomPIN
+}
+
+func NewGuestHandler(pin *RoomPIN) *GuestHandler {
+	return &GuestHandler{pin: pin}
+}
+
+func (h *GuestHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermManageUsers) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	guestsPage(h.pin != nil).Render(r.Context(), w)
+}
+
+func (h *GuestHandler) HandleJoinCode(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermManageUsers) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if h.pin == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	joinCode(h.pin.PIN(), h.pin.JoinURL()).Render(r.Context(), w)
+}
+
+func (h *GuestHandler) HandleRotate(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermManageUsers) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if h.pin == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	h.pin.Rotate()
+	joinCode(h.pin.PIN(), h.pin.JoinURL()).Render(r.Context(), w)
+}
+
+func (h *GuestHandler) HandleQRCode(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermManageUsers) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if h.pin == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size <= 0 || size > 1024 {
+		size = 512
+	}
+
+	img, err := h.pin.QRCode(size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := png.Encode(w, img); err != nil {
+		log.Println("error encoding QR code:", err)
+	}
+}
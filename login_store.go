@@ -0,0 +1,209 @@
+package mpvwebkaraoke
+
+import (
+	"context"
+	"encoding/gob"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Login is a logged in session kept on the server, so users can be checked
+// again and logged out after their cookie was issued.
+type Login struct {
+	ID       string
+	Provider string
+	User     User
+	// Token is the provider's OAuth token, nil for local providers.
+	Token   *oauth2.Token
+	Created time.Time
+	Checked time.Time
+}
+
+type LoginStoreConfig struct {
+	// MaxAge is how long a login lasts, forever if zero.
+	MaxAge time.Duration
+	// RefreshInterval is how often users are checked with their provider
+	// again, never if zero.
+	RefreshInterval time.Duration
+}
+
+type LoginStore struct {
+	config LoginStoreConfig
+	mu     sync.RWMutex
+	logins map[string]Login
+}
+
+func NewLoginStore(config LoginStoreConfig) *LoginStore {
+	return &LoginStore{config: config, logins: make(map[string]Login)}
+}
+
+// Start recovers logins from disk and persists them periodically.
+func (s *LoginStore) Start(ctx context.Context) error {
+	if err := s.recover(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.prune()
+				if err := s.persist(); err != nil {
+					log.Println("error persisting logins:", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *LoginStore) recover() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open("logins.gob")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer file.Close()
+	return gob.NewDecoder(file).Decode(&s.logins)
+}
+
+func (s *LoginStore) persist() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tempFile, err := os.CreateTemp("", "logins.*.gob")
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(tempFile).Encode(s.logins); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), "logins.gob")
+}
+
+func (s *LoginStore) expired(login Login) bool {
+	return s.config.MaxAge > 0 && time.Since(login.Created) > s.config.MaxAge
+}
+
+func (s *LoginStore) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, login := range s.logins {
+		if s.expired(login) {
+			delete(s.logins, id)
+		}
+	}
+}
+
+// Add stores a new login and returns its ID.
+func (s *LoginStore) Add(provider string, user User, token *oauth2.Token) Login {
+	now := time.Now()
+	login := Login{
+		ID:       newState(),
+		Provider: provider,
+		User:     user,
+		Token:    token,
+		Created:  now,
+		Checked:  now,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins[login.ID] = login
+	return login
+}
+
+// Get returns a login unless it does not exist or has expired.
+func (s *LoginStore) Get(id string) (Login, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	login, ok := s.logins[id]
+	if !ok || s.expired(login) {
+		return Login{}, false
+	}
+
+	return login, true
+}
+
+// Latest returns the most recently checked login of a user.
+func (s *LoginStore) Latest(userID string) (Login, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var latest Login
+	found := false
+
+	for _, login := range s.logins {
+		if login.User.ID != userID || s.expired(login) {
+			continue
+		}
+		if !found || login.Checked.After(latest.Checked) {
+			latest = login
+			found = true
+		}
+	}
+
+	return latest, found
+}
+
+// Claim marks a login as checked now if it was last checked longer than
+// interval ago, and reports whether the caller should check it. This keeps
+// concurrent requests from checking the same login at once.
+func (s *LoginStore) Claim(id string, interval time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, ok := s.logins[id]
+	if !ok || time.Since(login.Checked) < interval {
+		return false
+	}
+
+	login.Checked = time.Now()
+	s.logins[id] = login
+	return true
+}
+
+// Update replaces the user and token of a login after it was checked.
+func (s *LoginStore) Update(id string, user User, token *oauth2.Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, ok := s.logins[id]
+	if !ok {
+		return
+	}
+
+	login.User = user
+	login.Token = token
+	s.logins[id] = login
+}
+
+func (s *LoginStore) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.logins, id)
+}
@@ -0,0 +1,41 @@
+package mpvwebkaraoke
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+var integratedLoudnessPattern = regexp.MustCompile(`I:\s+(-?[0-9.]+) LUFS`)
+
+// measureLoudness returns the integrated loudness (EBU R128) of a media file in LUFS.
+func measureLoudness(ctx context.Context, filename string) (float64, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner",
+		"-nostats",
+		"-i", filename,
+		"-vn", "-sn", "-dn",
+		"-af", "ebur128=framelog=quiet",
+		"-f", "null",
+		"-",
+	)
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("failed to run ffmpeg: %w", err)
+	}
+
+	// the summary is printed last
+	matches := integratedLoudnessPattern.FindAllSubmatch(stderr.Bytes(), -1)
+	if len(matches) == 0 {
+		return 0, errors.New("integrated loudness not found in ffmpeg output")
+	}
+
+	return strconv.ParseFloat(string(matches[len(matches)-1][1]), 64)
+}
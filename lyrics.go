@@ -0,0 +1,285 @@
+package mpvwebkaraoke
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+type Lyrics struct {
+	Source string
+	Lines  []string
+}
+
+type lyricsStatus uint8
+
+const (
+	lyricsStatusPending lyricsStatus = iota
+	lyricsStatusAvailable
+	lyricsStatusFailed
+)
+
+type lyricsEntry struct {
+	status lyricsStatus
+	lyrics Lyrics
+	cancel context.CancelFunc
+}
+
+type LyricsStore struct {
+	languages []string
+	entries   map[int]*lyricsEntry
+	entriesMu sync.RWMutex
+}
+
+func NewLyricsStore(languages []string) *LyricsStore {
+	return &LyricsStore{
+		languages: languages,
+		entries:   make(map[int]*lyricsEntry),
+	}
+}
+
+// Fetch starts fetching lyrics for a song in the background. Lyrics are taken
+// from the song's lyrics URL if possible, and from the video's subtitles otherwise.
+func (s *LyricsStore) Fetch(ctx context.Context, song Song) {
+	s.entriesMu.Lock()
+	defer s.entriesMu.Unlock()
+
+	if _, ok := s.entries[song.ID]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.entries[song.ID] = &lyricsEntry{status: lyricsStatusPending, cancel: cancel}
+
+	go func() {
+		lyrics, err := s.fetch(ctx, song)
+		if err != nil {
+			log.Println("failed to fetch lyrics for", song.URL, ":", err)
+		}
+
+		s.entriesMu.Lock()
+		defer s.entriesMu.Unlock()
+
+		entry, ok := s.entries[song.ID]
+		if !ok {
+			return
+		}
+
+		if err != nil {
+			entry.status = lyricsStatusFailed
+			return
+		}
+
+		entry.status = lyricsStatusAvailable
+		entry.lyrics = lyrics
+	}()
+}
+
+func (s *LyricsStore) fetch(ctx context.Context, song Song) (lyrics Lyrics, err error) {
+	if song.LyricsURL.Valid {
+		lyrics, err = fetchPageLyrics(ctx, song.LyricsURL.String)
+		if err == nil {
+			return
+		}
+	}
+
+	var err2 error
+	lyrics, err2 = fetchSubtitleLyrics(ctx, song.URL, song.Subtitle, s.languages)
+	if err2 != nil {
+		err = errors.Join(err, err2)
+		return
+	}
+
+	return lyrics, nil
+}
+
+// Get returns the lyrics of a song. The second return value reports whether
+// lyrics are still being fetched.
+func (s *LyricsStore) Get(id int) (lyrics Lyrics, pending bool, ok bool) {
+	s.entriesMu.RLock()
+	defer s.entriesMu.RUnlock()
+
+	entry, exists := s.entries[id]
+	if !exists {
+		return Lyrics{}, false, false
+	}
+
+	switch entry.status {
+	case lyricsStatusPending:
+		return Lyrics{}, true, false
+	case lyricsStatusAvailable:
+		return entry.lyrics, false, true
+	default:
+		return Lyrics{}, false, false
+	}
+}
+
+// Clear cancels any pending fetch and forgets the lyrics of a song.
+func (s *LyricsStore) Clear(id int) {
+	s.entriesMu.Lock()
+	defer s.entriesMu.Unlock()
+
+	if entry, ok := s.entries[id]; ok {
+		entry.cancel()
+	}
+
+	delete(s.entries, id)
+}
+
+type lyricsExtractor func(doc *html.Node) []string
+
+var lyricsExtractors = map[string]lyricsExtractor{
+	"genius.com":               extractByAttr("data-lyrics-container", "true"),
+	"www.uta-net.com":          extractByAttr("id", "kashi_area"),
+	"uta-net.com":              extractByAttr("id", "kashi_area"),
+	"j-lyric.net":              extractByAttr("id", "Lyric"),
+	"utaten.com":               extractByClass("hiragana"),
+	"www.lyrical-nonsense.com": extractByClass("olyrictext"),
+	"www.animelyrics.com":      extractByAttr("id", "kanji"),
+}
+
+func fetchPageLyrics(ctx context.Context, lyricsURL string) (lyrics Lyrics, err error) {
+	u, err := url.Parse(lyricsURL)
+	if err != nil {
+		return
+	}
+
+	extract, ok := lyricsExtractors[u.Host]
+	if !ok {
+		err = fmt.Errorf("no lyrics extractor for %s", u.Host)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lyricsURL, nil)
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:124.0) Gecko/20100101 Firefox/124.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected status fetching lyrics: %s", resp.Status)
+		return
+	}
+
+	doc, err := html.Parse(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		err = fmt.Errorf("failed to parse lyrics page: %w", err)
+		return
+	}
+
+	lines := extract(doc)
+	if len(lines) == 0 {
+		err = errors.New("no lyrics found on page")
+		return
+	}
+
+	lyrics = Lyrics{Source: lyricsURL, Lines: lines}
+	return
+}
+
+func extractByAttr(key, value string) lyricsExtractor {
+	return func(doc *html.Node) []string {
+		return extractMatching(doc, func(n *html.Node) bool {
+			return nodeAttr(n, key) == value
+		})
+	}
+}
+
+func extractByClass(class string) lyricsExtractor {
+	return func(doc *html.Node) []string {
+		return extractMatching(doc, func(n *html.Node) bool {
+			for _, c := range strings.Fields(nodeAttr(n, "class")) {
+				if c == class {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
+
+func nodeAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// extractMatching collects the text of every element matching the predicate,
+// keeping line breaks and dropping furigana.
+func extractMatching(doc *html.Node, match func(*html.Node) bool) []string {
+	text := &strings.Builder{}
+
+	var walk func(n *html.Node, inside bool)
+	walk = func(n *html.Node, inside bool) {
+		if n.Type == html.ElementNode {
+			switch n.DataAtom {
+			case atom.Script, atom.Style, atom.Rt, atom.Rp:
+				return
+			case atom.Br:
+				if inside {
+					text.WriteByte('\n')
+				}
+				return
+			}
+
+			if !inside && match(n) {
+				inside = true
+				defer text.WriteByte('\n')
+			}
+		}
+
+		if inside && n.Type == html.TextNode {
+			text.WriteString(n.Data)
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, inside)
+		}
+
+		if inside && n.Type == html.ElementNode && (n.DataAtom == atom.P || n.DataAtom == atom.Div) {
+			text.WriteByte('\n')
+		}
+	}
+
+	walk(doc, false)
+	return splitLyricsLines(text.String())
+}
+
+// splitLyricsLines splits text into trimmed lines, collapsing runs of blank
+// lines into a single stanza break.
+func splitLyricsLines(text string) []string {
+	lines := make([]string, 0)
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" && (len(lines) == 0 || lines[len(lines)-1] == "") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
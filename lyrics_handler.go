@@ -0,0 +1,30 @@
+package mpvwebkaraoke
+
+import (
+	"net/http"
+)
+
+type LyricsHandler struct {
+	queue  *Queue
+	lyrics *LyricsStore
+}
+
+func NewLyricsHandler(queue *Queue, lyrics *LyricsStore) *LyricsHandler {
+	return &LyricsHandler{queue: queue, lyrics: lyrics}
+}
+
+func (h *LyricsHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
+	lyricsPage().Render(r.Context(), w)
+}
+
+func (h *LyricsHandler) HandleCurrentLyrics(w http.ResponseWriter, r *http.Request) {
+	song, ok := h.queue.LastDequeued()
+
+	if !ok {
+		currentLyrics(nil, Lyrics{}, false).Render(r.Context(), w)
+		return
+	}
+
+	lyrics, pending, _ := h.lyrics.Get(song.ID)
+	currentLyrics(&song, lyrics, pending).Render(r.Context(), w)
+}
@@ -0,0 +1,185 @@
+package mpvwebkaraoke
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBanned   = errors.New("you are banned")
+	ErrTimedOut = errors.New("you are timed out")
+)
+
+// Sanction is what moderators did to a user.
+type Sanction struct {
+	User         User
+	Banned       bool
+	Hidden       bool
+	TimeoutUntil time.Time
+}
+
+func (s Sanction) TimedOut() bool {
+	return time.Now().Before(s.TimeoutUntil)
+}
+
+func (s Sanction) active() bool {
+	return s.Banned || s.Hidden || s.TimedOut()
+}
+
+// Moderation keeps track of banned, timed out and hidden users. Changes are
+// written to disk right away so they survive restarts.
+type Moderation struct {
+	mu        sync.RWMutex
+	path      string
+	sanctions map[string]Sanction
+}
+
+// NewModeration loads sanctions from the file at path, which is created on
+// the first change. Nothing is persisted if path is empty.
+func NewModeration(path string) (*Moderation, error) {
+	m := &Moderation{path: path, sanctions: make(map[string]Sanction)}
+	if path == "" {
+		return m, nil
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	if err := gob.NewDecoder(file).Decode(&m.sanctions); err != nil {
+		return nil, fmt.Errorf("failed to decode moderation: %w", err)
+	}
+
+	return m, nil
+}
+
+func (m *Moderation) persistLocked() error {
+	if m.path == "" {
+		return nil
+	}
+
+	tempFile, err := os.CreateTemp("", "moderation.*.gob")
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(tempFile).Encode(m.sanctions); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), m.path)
+}
+
+// update applies fn to the sanction of a user, forgetting it once nothing
+// applies anymore.
+func (m *Moderation) update(user User, fn func(*Sanction)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sanctions[user.ID]
+	if !ok {
+		s.User = user
+	}
+
+	fn(&s)
+
+	if s.active() {
+		m.sanctions[user.ID] = s
+	} else {
+		delete(m.sanctions, user.ID)
+	}
+
+	return m.persistLocked()
+}
+
+func (m *Moderation) SetBanned(user User, banned bool) error {
+	return m.update(user, func(s *Sanction) { s.Banned = banned })
+}
+
+func (m *Moderation) SetHidden(user User, hidden bool) error {
+	return m.update(user, func(s *Sanction) { s.Hidden = hidden })
+}
+
+// Timeout stops a user from requesting for d, or lifts their timeout if d is zero.
+func (m *Moderation) Timeout(user User, d time.Duration) error {
+	return m.update(user, func(s *Sanction) { s.TimeoutUntil = time.Now().Add(d) })
+}
+
+func (m *Moderation) Get(id string) (Sanction, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sanctions[id]
+	return s, ok && s.active()
+}
+
+// List returns the sanctions that still apply.
+func (m *Moderation) List() []Sanction {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sanctions := make([]Sanction, 0, len(m.sanctions))
+	for _, s := range m.sanctions {
+		if s.active() {
+			sanctions = append(sanctions, s)
+		}
+	}
+	return sanctions
+}
+
+// CheckRequest reports why a user may not request songs, or nil if they may.
+func (m *Moderation) CheckRequest(id string) error {
+	s, ok := m.Get(id)
+	switch {
+	case !ok:
+		return nil
+	case s.Banned:
+		return ErrBanned
+	case s.TimedOut():
+		return fmt.Errorf("%w for another %s", ErrTimedOut, time.Until(s.TimeoutUntil).Round(time.Second))
+	default:
+		return nil
+	}
+}
+
+// canModerate reports whether a user may sanction another. Admins, who have
+// every permission, cannot be sanctioned, and only they may sanction other
+// user managers.
+func canModerate(moderator, target User) bool {
+	switch {
+	case moderator.ID == target.ID, target.Can(AllPermissions):
+		return false
+	case target.Can(PermManageUsers):
+		return moderator.Can(AllPermissions)
+	default:
+		return moderator.Can(PermManageUsers)
+	}
+}
+
+// Restrict removes the permissions a sanctioned user may not use. Banned
+// users lose every permission and timed out users may not request songs.
+// Admins are never restricted.
+func (m *Moderation) Restrict(user User) User {
+	s, ok := m.Get(user.ID)
+	switch {
+	case !ok, user.Can(AllPermissions):
+	case s.Banned:
+		user.Permissions = 0
+	case s.TimedOut():
+		user.Permissions &^= PermRequest
+	}
+	return user
+}
@@ -0,0 +1,100 @@
+package mpvwebkaraoke
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ModerationHandler lets user managers sanction users. The logins are used to
+// look up what the users they sanction may do.
+type ModerationHandler struct {
+	moderation *Moderation
+	logins     *LoginStore
+}
+
+func NewModerationHandler(moderation *Moderation, logins *LoginStore) *ModerationHandler {
+	return &ModerationHandler{moderation: moderation, logins: logins}
+}
+
+func (h *ModerationHandler) render(w http.ResponseWriter, r *http.Request) {
+	sanctions := h.moderation.List()
+	slices.SortFunc(sanctions, func(a, b Sanction) int { return strings.Compare(a.User.Name, b.User.Name) })
+	moderationList(sanctions).Render(r.Context(), w)
+}
+
+func (h *ModerationHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermManageUsers) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	h.render(w, r)
+}
+
+// HandlePostAction bans, times out or hides a user, or undoes it.
+func (h *ModerationHandler) HandlePostAction(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermManageUsers) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	target := User{ID: r.PathValue("id"), Name: r.FormValue("name")}
+	if target.ID == user.ID {
+		http.Error(w, "you cannot moderate yourself", http.StatusBadRequest)
+		return
+	}
+
+	action := r.FormValue("action")
+	lifting := action == "unban" || action == "unhide" || (action == "timeout" && r.FormValue("minutes") == "0")
+
+	// without a login it is not known what the target may do, so only admins
+	// may sanction them in case they are an admin or user manager
+	login, known := h.logins.Latest(target.ID)
+	switch {
+	case known && !canModerate(user, login.User), !known && !lifting && !user.Can(AllPermissions):
+		http.Error(w, "you cannot moderate this user", http.StatusForbidden)
+		return
+	}
+
+	if s, ok := h.moderation.Get(target.ID); ok {
+		target = s.User
+	}
+
+	var err error
+
+	switch action {
+	case "ban":
+		err = h.moderation.SetBanned(target, true)
+	case "unban":
+		err = h.moderation.SetBanned(target, false)
+	case "hide":
+		err = h.moderation.SetHidden(target, true)
+	case "unhide":
+		err = h.moderation.SetHidden(target, false)
+	case "timeout":
+		minutes, convErr := strconv.Atoi(r.FormValue("minutes"))
+		if convErr != nil || minutes < 0 {
+			http.Error(w, "invalid minutes", http.StatusBadRequest)
+			return
+		}
+		err = h.moderation.Timeout(target, time.Duration(minutes)*time.Minute)
+	default:
+		http.Error(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		log.Println("error saving moderation:", err)
+		http.Error(w, "failed to save moderation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("HX-Trigger", "moderation:change")
+	h.render(w, r)
+}
@@ -0,0 +1,191 @@
+package mpvwebkaraoke
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// overlayRefresh is how often the overlay is sent the playback position even
+// if nothing changed, which also keeps the connection alive.
+const overlayRefresh = 10 * time.Second
+
+var (
+	overlayLayouts = []string{"bar", "card", "list"}
+	cssColorRegexp = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]{1,20})$`)
+	hexColorRegexp = regexp.MustCompile(`^[0-9a-fA-F]{3,8}$`)
+	cssFontRegexp  = regexp.MustCompile(`^[a-zA-Z0-9 ,'-]{1,100}$`)
+)
+
+// overlayOptions style the overlay, set in the query string.
+type overlayOptions struct {
+	Layout     string
+	Color      string
+	Accent     string
+	Background string
+	Font       string
+	Scale      float64
+	Next       int
+}
+
+func parseOverlayOptions(r *http.Request) overlayOptions {
+	q := r.URL.Query()
+	o := overlayOptions{
+		Layout:     "bar",
+		Color:      "#ffffff",
+		Accent:     "#38bdf8",
+		Background: "#000000b3",
+		Font:       "sans-serif",
+		Scale:      1,
+		Next:       3,
+	}
+
+	if slices.Contains(overlayLayouts, q.Get("layout")) {
+		o.Layout = q.Get("layout")
+	}
+
+	// colors and fonts end up in CSS, anything else is ignored. The # of hex
+	// colors may be left out so they need no escaping.
+	cssColor := func(s string) (string, bool) {
+		if hexColorRegexp.MatchString(s) {
+			s = "#" + s
+		}
+		return s, cssColorRegexp.MatchString(s)
+	}
+
+	if c, ok := cssColor(q.Get("color")); ok {
+		o.Color = c
+	}
+	if c, ok := cssColor(q.Get("accent")); ok {
+		o.Accent = c
+	}
+	if c, ok := cssColor(q.Get("bg")); ok {
+		o.Background = c
+	}
+	if f := q.Get("font"); cssFontRegexp.MatchString(f) {
+		o.Font = f
+	}
+	if s, err := strconv.ParseFloat(q.Get("scale"), 64); err == nil && s >= 0.25 && s <= 4 {
+		o.Scale = s
+	}
+	if n, err := strconv.Atoi(q.Get("next")); err == nil && n >= 0 && n <= 10 {
+		o.Next = n
+	}
+
+	return o
+}
+
+// overlayState is what the overlay shows.
+type overlayState struct {
+	Current  *songJSON  `json:"current"`
+	Position float64    `json:"position"`
+	Paused   bool       `json:"paused"`
+	Next     []songJSON `json:"next"`
+}
+
+// OverlayHandler serves a page for OBS browser sources showing the current song
+// and what is next. It has no login, the token in its URL protects it.
+type OverlayHandler struct {
+	queue *QueueHandler
+	token string
+}
+
+func NewOverlayHandler(queue *QueueHandler, token string) *OverlayHandler {
+	return &OverlayHandler{queue: queue, token: token}
+}
+
+func (h *OverlayHandler) authorized(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(h.token)) == 1
+}
+
+func (h *OverlayHandler) state(next int) overlayState {
+	state := overlayState{Next: newSongsJSON(h.queue.queue.List())}
+	state.Next = state.Next[:min(next, len(state.Next))]
+
+	if progress, ok := h.queue.player.Progress(); ok {
+		song := newSongJSON(progress.Song)
+		state.Current = &song
+		state.Position = progress.Position.Seconds()
+		state.Paused = progress.Paused
+	}
+
+	return state
+}
+
+func (h *OverlayHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	overlayPage(parseOverlayOptions(r), "/overlay/events?"+r.URL.RawQuery).Render(r.Context(), w)
+}
+
+// HandleEvents sends the overlay state whenever the queue or playback changes.
+func (h *OverlayHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	options := parseOverlayOptions(r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	rc := http.NewResponseController(w)
+
+	sub, _, _ := h.queue.events.subscribe("")
+	defer func() { h.queue.events.unsubscribe(sub) }()
+
+	refresh := time.NewTicker(overlayRefresh)
+	defer refresh.Stop()
+
+	for {
+		data, err := json.Marshal(h.state(options.Next))
+		if err != nil {
+			return
+		}
+
+		rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+		fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+
+		// clients that stop reading hit the write deadline and are disconnected
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		var ok bool
+		if sub, ok = h.wait(r.Context(), sub, refresh.C); !ok {
+			return
+		}
+	}
+}
+
+// wait blocks until the overlay should be sent again, returning the
+// subscription to keep using, or false once the client is gone.
+func (h *OverlayHandler) wait(ctx context.Context, sub *subscriber, refresh <-chan time.Time) (*subscriber, bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return sub, false
+		case <-sub.lagged:
+			sub, _, _ = h.queue.events.subscribe("")
+			return sub, true
+		case e := <-sub.events:
+			switch e.Event {
+			case RerenderQueue, AppendQueue, RemoveQueue, UpdateQueue, PlaybackStart, PlaybackEnd:
+				return sub, true
+			}
+		case <-refresh:
+			return sub, true
+		}
+	}
+}
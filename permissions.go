@@ -0,0 +1,127 @@
+package mpvwebkaraoke
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Permissions is a set of things a user may do.
+type Permissions uint
+
+const (
+	// PermRequest allows requesting songs.
+	PermRequest Permissions = 1 << iota
+	// PermSkipOwn allows removing and skipping one's own songs.
+	PermSkipOwn
+	// PermReorder allows moving songs in the queue.
+	PermReorder
+	// PermRevokeAny allows removing and skipping anyone's songs.
+	PermRevokeAny
+	// PermPlaybackControl allows changing how songs play and when singers are called.
+	PermPlaybackControl
+	// PermManageUsers allows inviting guests and moderating users.
+	PermManageUsers
+	// PermUnlimitedQueue exempts a user from queue limits.
+	PermUnlimitedQueue
+
+	AllPermissions = PermRequest | PermSkipOwn | PermReorder | PermRevokeAny |
+		PermPlaybackControl | PermManageUsers | PermUnlimitedQueue
+)
+
+var permissionNames = []struct {
+	name string
+	perm Permissions
+}{
+	{"request", PermRequest},
+	{"skip-own", PermSkipOwn},
+	{"reorder", PermReorder},
+	{"revoke-any", PermRevokeAny},
+	{"playback-control", PermPlaybackControl},
+	{"manage-users", PermManageUsers},
+	{"unlimited-queue", PermUnlimitedQueue},
+}
+
+// ParsePermissions parses a comma separated list of permission names, or
+// "all" for every permission.
+func ParsePermissions(s string) (Permissions, error) {
+	var perms Permissions
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if name == "all" {
+			perms |= AllPermissions
+			continue
+		}
+
+		found := false
+		for _, p := range permissionNames {
+			if p.name == name {
+				perms |= p.perm
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+	}
+
+	return perms, nil
+}
+
+func (p Permissions) Has(perm Permissions) bool {
+	return p&perm == perm
+}
+
+func (p Permissions) String() string {
+	names := make([]string, 0, len(permissionNames))
+	for _, n := range permissionNames {
+		if p.Has(n.perm) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// RolePermissions maps Discord role IDs or OIDC groups to the permissions
+// their members get.
+type RolePermissions map[string]Permissions
+
+// ParseRolePermissions parses semicolon separated mappings of the form
+// role=permission,permission.
+func ParseRolePermissions(s string) (RolePermissions, error) {
+	roles := make(RolePermissions)
+
+	for _, mapping := range strings.Split(s, ";") {
+		if strings.TrimSpace(mapping) == "" {
+			continue
+		}
+
+		role, perms, ok := strings.Cut(mapping, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid role permissions %q", mapping)
+		}
+
+		p, err := ParsePermissions(perms)
+		if err != nil {
+			return nil, err
+		}
+
+		roles[strings.TrimSpace(role)] |= p
+	}
+
+	return roles, nil
+}
+
+// For returns the base permissions combined with those of every role.
+func (r RolePermissions) For(roles []string, base Permissions) Permissions {
+	for _, role := range roles {
+		base |= r[role]
+	}
+	return base
+}
@@ -0,0 +1,237 @@
+package mpvwebkaraoke
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MinKey   = -12
+	MaxKey   = 12
+	MinSpeed = 0.75
+	MaxSpeed = 1.25
+
+	// maxLoudnessGain limits how much quiet songs are boosted, in dB.
+	maxLoudnessGain = 12
+)
+
+type PlayerConfig struct {
+	IPCPath string
+	// VocalFilter is the audio filter used to reduce vocals, in mpv --af syntax.
+	VocalFilter string
+	// LoudnessTarget is the integrated loudness in LUFS songs are adjusted to.
+	// Normalisation is disabled if it is zero.
+	LoudnessTarget float64
+}
+
+type PlaybackEventHandler func(Song)
+
+// Player runs mpv and controls it over its JSON IPC socket while a song is playing.
+type Player struct {
+	config        PlayerConfig
+	mu            sync.Mutex
+	playing       *Song
+	gain          float64
+	startHandlers []PlaybackEventHandler
+	endHandlers   []PlaybackEventHandler
+}
+
+func NewPlayer(config PlayerConfig) *Player {
+	return &Player{config: config}
+}
+
+func pitchScale(key int) float64 {
+	return math.Pow(2, float64(key)/12)
+}
+
+func (p *Player) audioFilters(song Song) string {
+	filters := make([]string, 0)
+
+	if song.ReduceVocals && p.config.VocalFilter != "" {
+		filters = append(filters, "@vocals:"+p.config.VocalFilter)
+	}
+
+	if p.gain != 0 {
+		filters = append(filters, fmt.Sprintf("@loudness:lavfi=[volume=%.2fdB]", p.gain))
+	}
+
+	if song.Key != 0 {
+		filters = append(filters, fmt.Sprintf("@key:rubberband=pitch-scale=%f", pitchScale(song.Key)))
+	}
+
+	return strings.Join(filters, ",")
+}
+
+func (p *Player) loudnessGain(loudness sql.NullFloat64) float64 {
+	if p.config.LoudnessTarget == 0 || !loudness.Valid {
+		return 0
+	}
+
+	return min(p.config.LoudnessTarget-loudness.Float64, maxLoudnessGain)
+}
+
+// Play runs mpv with the given arguments until it exits, applying the
+// playback settings of the song and normalising its measured loudness.
+func (p *Player) Play(song Song, loudness sql.NullFloat64, args []string) error {
+	p.mu.Lock()
+	p.playing = &song
+	p.gain = p.loudnessGain(loudness)
+	filters := p.audioFilters(song)
+	startHandlers, endHandlers := p.startHandlers, p.endHandlers
+	p.mu.Unlock()
+
+	for _, h := range startHandlers {
+		h(song)
+	}
+
+	defer func() {
+		p.mu.Lock()
+		p.playing = nil
+		p.gain = 0
+		p.mu.Unlock()
+
+		for _, h := range endHandlers {
+			h(song)
+		}
+	}()
+
+	args = append([]string{
+		"--input-ipc-server=" + p.config.IPCPath,
+		"--af=" + filters,
+		"--audio-pitch-correction=yes",
+		fmt.Sprintf("--speed=%f", song.PlaybackSpeed()),
+	}, args...)
+
+	cmd := exec.Command("mpv", args...)
+	return cmd.Run()
+}
+
+// Apply updates the playback settings of mpv if the song is the one playing.
+func (p *Player) Apply(song Song) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.playing == nil || p.playing.ID != song.ID {
+		return nil
+	}
+
+	*p.playing = song
+
+	if err := p.command("af", "set", p.audioFilters(song)); err != nil {
+		return err
+	}
+
+	return p.command("set_property", "speed", song.PlaybackSpeed())
+}
+
+// Stop ends playback if the song is the one playing.
+func (p *Player) Stop(song Song) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.playing == nil || p.playing.ID != song.ID {
+		return nil
+	}
+
+	return p.command("quit")
+}
+
+// OnStart calls h before each song starts playing.
+func (p *Player) OnStart(h PlaybackEventHandler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.startHandlers = append(p.startHandlers, h)
+}
+
+// OnEnd calls h after each song has played or was skipped.
+func (p *Player) OnEnd(h PlaybackEventHandler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endHandlers = append(p.endHandlers, h)
+}
+
+// PlaybackProgress is how far the playing song is.
+type PlaybackProgress struct {
+	Song     Song
+	Position time.Duration
+	Paused   bool
+}
+
+// Progress returns the song that is playing and how far it is. The position
+// is zero while the preview frame is shown before the song starts.
+func (p *Player) Progress() (PlaybackProgress, bool) {
+	p.mu.Lock()
+	if p.playing == nil {
+		p.mu.Unlock()
+		return PlaybackProgress{}, false
+	}
+	progress := PlaybackProgress{Song: *p.playing, Paused: true}
+	p.mu.Unlock()
+
+	// mpv is asked without holding the lock, so a slow reply does not hold
+	// up skipping or adjusting the song
+
+	var seconds float64
+	if data, err := p.request("get_property", "time-pos"); err == nil && json.Unmarshal(data, &seconds) == nil {
+		progress.Position = time.Duration(seconds * float64(time.Second))
+	}
+
+	if data, err := p.request("get_property", "pause"); err == nil {
+		json.Unmarshal(data, &progress.Paused)
+	}
+
+	return progress, true
+}
+
+type mpvReply struct {
+	Error *string         `json:"error"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func (p *Player) command(args ...any) error {
+	_, err := p.request(args...)
+	return err
+}
+
+// request sends a command to mpv and returns the data of its reply.
+func (p *Player) request(args ...any) (json.RawMessage, error) {
+	conn, err := net.DialTimeout("unix", p.config.IPCPath, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to mpv: %w", err)
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(map[string]any{"command": args}); err != nil {
+		return nil, fmt.Errorf("failed to send mpv command: %w", err)
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		var reply mpvReply
+		if err := dec.Decode(&reply); err != nil {
+			return nil, fmt.Errorf("failed to read mpv reply: %w", err)
+		}
+
+		// events may arrive before the reply
+		if reply.Event != "" || reply.Error == nil {
+			continue
+		}
+
+		if *reply.Error != "success" {
+			return nil, errors.New("mpv: " + *reply.Error)
+		}
+
+		return reply.Data, nil
+	}
+}
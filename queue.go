@@ -6,33 +6,59 @@ import (
 	"encoding/gob"
 	"log"
 	"os"
+	"slices"
 	"sync"
 	"time"
 )
 
 type Song struct {
-	ID        int
-	Requester User
-	Title     string
-	Thumbnail string
-	URL       string
-	LyricsURL sql.NullString
-	Duration  time.Duration
+	ID           int
+	Requester    User
+	Title        string
+	Thumbnail    string
+	URL          string
+	LyricsURL    sql.NullString
+	Subtitle     Subtitle
+	Key          int
+	Speed        float64
+	ReduceVocals bool
+	Duration     time.Duration
+}
+
+// PlaybackSpeed returns the tempo the song is played at. Songs persisted before
+// tempo adjustment existed have no speed set and play at normal speed.
+func (s Song) PlaybackSpeed() float64 {
+	if s.Speed == 0 {
+		return 1
+	}
+	return s.Speed
+}
+
+// PlaybackDuration returns how long the song takes to play at its tempo.
+func (s Song) PlaybackDuration() time.Duration {
+	return time.Duration(float64(s.Duration) / s.PlaybackSpeed())
 }
 
 type PushEventHandler func(Song)
 type RemoveEventHandler func(int)
+type UpdateEventHandler func(Song)
+type ReorderEventHandler func([]Song)
 
 type Queue struct {
-	mu             sync.RWMutex
-	cond           *sync.Cond
-	id             int
-	userLimit      int
-	current        []Song
-	dequeued       []Song
-	revoked        []Song
-	pushHandlers   []PushEventHandler
-	removeHandlers []RemoveEventHandler
+	mu              sync.RWMutex
+	cond            *sync.Cond
+	id              int
+	limits          QueueLimits
+	overrides       map[string]UserLimits
+	requests        map[string][]time.Time
+	current         []Song
+	dequeued        []Song
+	revoked         []Song
+	pushHandlers    []PushEventHandler
+	removeHandlers  []RemoveEventHandler
+	revokeHandlers  []RemoveEventHandler
+	updateHandlers  []UpdateEventHandler
+	reorderHandlers []ReorderEventHandler
 }
 
 func (q *Queue) Start(ctx context.Context) error {
@@ -63,6 +89,10 @@ func (q *Queue) recoverChanges() error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
+	if err := q.recoverLimits(); err != nil {
+		return err
+	}
+
 	currentFile, err := os.Open("current.gob")
 	if os.IsNotExist(err) {
 		return nil
@@ -106,37 +136,29 @@ func (q *Queue) persistChanges() error {
 		return err
 	}
 
-	return nil
+	return q.persistLimits()
 }
 
-func NewQueue(perUserLimit int) *Queue {
+func NewQueue(limits QueueLimits) *Queue {
 	q := &Queue{}
-	q.userLimit = perUserLimit
+	q.limits = limits
+	q.overrides = make(map[string]UserLimits)
+	q.requests = make(map[string][]time.Time)
 	q.cond = sync.NewCond(&q.mu)
 	return q
 }
 
-func (q *Queue) Push(song Song) bool {
+// Push adds a song to the queue unless it would exceed the requester's limits,
+// returning it with its ID.
+func (q *Queue) Push(song Song) (Song, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	var c int
-
-	if song.Requester.Admin {
-		goto push
+	if err := q.checkLimitsLocked(song.Requester, song.PlaybackDuration()); err != nil {
+		return Song{}, err
 	}
 
-	for _, s := range q.current {
-		if s.Requester.ID == song.Requester.ID {
-			c++
-		}
-	}
-
-	if c >= q.userLimit {
-		return false
-	}
-
-push:
+	q.recordRequestLocked(song.Requester.ID)
 	song.ID = q.id
 	q.current = append(q.current, song)
 	q.id++
@@ -146,7 +168,7 @@ push:
 	}
 
 	q.cond.Signal()
-	return true
+	return song, nil
 }
 
 func (q *Queue) List() []Song {
@@ -177,6 +199,10 @@ func (q *Queue) Revoke(id int) (ok bool) {
 				h(id)
 			}
 
+			for _, h := range q.revokeHandlers {
+				h(id)
+			}
+
 			return true
 		}
 	}
@@ -184,6 +210,86 @@ func (q *Queue) Revoke(id int) (ok bool) {
 	return false
 }
 
+// Update applies fn to the queued or currently playing song with the given ID.
+func (q *Queue) Update(id int, fn func(*Song)) (Song, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var song *Song
+
+	for i := range q.current {
+		if q.current[i].ID == id {
+			song = &q.current[i]
+			break
+		}
+	}
+
+	if song == nil && len(q.dequeued) > 0 && q.dequeued[len(q.dequeued)-1].ID == id {
+		song = &q.dequeued[len(q.dequeued)-1]
+	}
+
+	if song == nil {
+		return Song{}, false
+	}
+
+	fn(song)
+	song.ID = id
+
+	for _, h := range q.updateHandlers {
+		h(*song)
+	}
+
+	return *song, true
+}
+
+// Requeue puts a dequeued song back into the queue at the given position,
+// keeping its ID.
+func (q *Queue) Requeue(song Song, position int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if n := len(q.dequeued); n > 0 && q.dequeued[n-1].ID == song.ID {
+		q.dequeued = q.dequeued[:n-1]
+	}
+
+	position = max(0, min(position, len(q.current)))
+	q.current = slices.Insert(q.current, position, song)
+
+	songs := make([]Song, len(q.current))
+	copy(songs, q.current)
+
+	for _, h := range q.reorderHandlers {
+		h(songs)
+	}
+
+	q.cond.Signal()
+}
+
+// Move moves a queued song to the given position.
+func (q *Queue) Move(id, position int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := slices.IndexFunc(q.current, func(s Song) bool { return s.ID == id })
+	if i < 0 {
+		return false
+	}
+
+	song := q.current[i]
+	q.current = slices.Delete(q.current, i, i+1)
+	position = max(0, min(position, len(q.current)))
+	q.current = slices.Insert(q.current, position, song)
+
+	songs := make([]Song, len(q.current))
+	copy(songs, q.current)
+
+	for _, h := range q.reorderHandlers {
+		h(songs)
+	}
+
+	return true
+}
+
 func (q *Queue) Dequeue() Song {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -214,6 +320,17 @@ func (q *Queue) LastDequeued() (Song, bool) {
 	return q.dequeued[len(q.dequeued)-1], true
 }
 
+// History returns the songs that have been played, most recent first.
+func (q *Queue) History() []Song {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	songs := make([]Song, len(q.dequeued))
+	copy(songs, q.dequeued)
+	slices.Reverse(songs)
+	return songs
+}
+
 func (q *Queue) OnPush(h PushEventHandler) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -225,3 +342,23 @@ func (q *Queue) OnRemove(h RemoveEventHandler) {
 	defer q.mu.Unlock()
 	q.removeHandlers = append(q.removeHandlers, h)
 }
+
+// OnRevoke calls h when a song is taken out of the queue before it was
+// dequeued, unlike OnRemove which is also called by Dequeue.
+func (q *Queue) OnRevoke(h RemoveEventHandler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.revokeHandlers = append(q.revokeHandlers, h)
+}
+
+func (q *Queue) OnUpdate(h UpdateEventHandler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.updateHandlers = append(q.updateHandlers, h)
+}
+
+func (q *Queue) OnReorder(h ReorderEventHandler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reorderHandlers = append(q.reorderHandlers, h)
+}
@@ -3,9 +3,13 @@ package mpvwebkaraoke
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,12 +17,21 @@ import (
 )
 
 type QueueHandler struct {
-	queue            *Queue
-	listeners        []chan<- queueEvent
-	listenersMu      sync.RWMutex
-	maxUserQueueSize int
-	connections      map[User]int
-	connectionsMu    sync.RWMutex
+	queue             *Queue
+	player            *Player
+	readiness         *Readiness
+	moderation        *Moderation
+	events            *broadcaster
+	subtitleLanguages []string
+	connections       map[string]*connection
+	connectionsMu     sync.RWMutex
+}
+
+// connection counts the event streams of a user, who is kept as they were
+// when they last connected.
+type connection struct {
+	user  User
+	count int
 }
 
 type eventType string
@@ -27,23 +40,35 @@ const (
 	RerenderQueue eventType = "queue:set"
 	AppendQueue   eventType = "queue:push"
 	RemoveQueue   eventType = "queue:remove"
+	UpdateQueue   eventType = "queue:update"
 	SessionJoin   eventType = "session:join"
 	SessionLeave  eventType = "session:leave"
+	SingerCall    eventType = "singer:call"
+	Reaction      eventType = "reaction"
+	PlaybackStart eventType = "playback:start"
+	PlaybackEnd   eventType = "playback:end"
 )
 
 type queueEvent struct {
+	ID     string
 	Event  eventType
 	Song   Song
+	Songs  []Song
 	SongID int
 	User   User
+	Wait   time.Duration
+	Emoji  string
 }
 
-func NewQueueHandler(queue *Queue, maxUserQueueSize int) *QueueHandler {
+func NewQueueHandler(queue *Queue, player *Player, readiness *Readiness, moderation *Moderation, subtitleLanguages []string) *QueueHandler {
 	h := &QueueHandler{
-		queue:            queue,
-		listeners:        make([]chan<- queueEvent, 0),
-		maxUserQueueSize: maxUserQueueSize,
-		connections:      make(map[User]int),
+		queue:             queue,
+		player:            player,
+		readiness:         readiness,
+		moderation:        moderation,
+		events:            newBroadcaster(),
+		subtitleLanguages: subtitleLanguages,
+		connections:       make(map[string]*connection),
 	}
 
 	queue.OnPush(func(s Song) {
@@ -54,41 +79,31 @@ func NewQueueHandler(queue *Queue, maxUserQueueSize int) *QueueHandler {
 		h.sendEvent(queueEvent{Event: RemoveQueue, SongID: id})
 	})
 
-	return h
-}
+	queue.OnUpdate(func(s Song) {
+		h.sendEvent(queueEvent{Event: UpdateQueue, Song: s})
+	})
 
-func (h *QueueHandler) addListener(c chan<- queueEvent) {
-	h.listenersMu.Lock()
-	defer h.listenersMu.Unlock()
-	h.listeners = append(h.listeners, c)
-}
+	queue.OnReorder(func(songs []Song) {
+		h.sendEvent(queueEvent{Event: RerenderQueue, Songs: songs})
+	})
 
-func (h *QueueHandler) removeListener(c chan<- queueEvent) {
-	h.listenersMu.Lock()
-	defer h.listenersMu.Unlock()
-	for i, l := range h.listeners {
-		if l == c {
-			h.listeners = append(h.listeners[:i], h.listeners[i+1:]...)
-			break
-		}
-	}
-}
+	readiness.OnCall(func(s Song, wait time.Duration) {
+		h.sendEvent(queueEvent{Event: SingerCall, Song: s, Wait: wait})
+	})
 
-func (h *QueueHandler) sendEvent(e queueEvent) {
-	h.listenersMu.RLock()
-	defer h.listenersMu.RUnlock()
-	for _, l := range h.listeners {
-		l <- e
-	}
-}
+	player.OnStart(func(s Song) {
+		h.sendEvent(queueEvent{Event: PlaybackStart, Song: s})
+	})
 
-func (h *QueueHandler) renderQueueLocked(ctx context.Context) (html string, unlock func()) {
-	songs, unlock := h.queue.Freeze()
+	player.OnEnd(func(s Song) {
+		h.sendEvent(queueEvent{Event: PlaybackEnd, Song: s})
+	})
+
+	return h
+}
 
-	table := &strings.Builder{}
-	queueTable(songs).Render(ctx, table)
-	html = table.String()
-	return
+func (h *QueueHandler) sendEvent(e queueEvent) {
+	h.events.publish(e)
 }
 
 func (h *QueueHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
@@ -97,6 +112,12 @@ func (h *QueueHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *QueueHandler) HandleSubmissionPage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermRequest) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	q := r.URL.Query()
 	songURL := q.Get("url")
 	lyricsURL := q.Get("lyricsURL")
@@ -105,9 +126,26 @@ func (h *QueueHandler) HandleSubmissionPage(w http.ResponseWriter, r *http.Reque
 }
 
 func (h *QueueHandler) HandlePostPreview(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermRequest) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	songURL := r.FormValue("url")
 	lyricsURL := r.FormValue("lyricsURL")
 
+	// Probing subtitles spawns yt-dlp, so do it while the video info is fetched.
+	// Subtitles are optional and a failed probe only means none can be chosen.
+	subtitlesDone := make(chan []Subtitle, 1)
+	go func() {
+		tracks, err := probeSubtitles(r.Context(), songURL)
+		if err != nil {
+			log.Println("failed to probe subtitles for", songURL, ":", err)
+		}
+		subtitlesDone <- listSubtitleTracks(tracks, h.subtitleLanguages)
+	}()
+
 	video, err := getVideoInfo(r.Context(), songURL)
 
 	if err != nil {
@@ -115,12 +153,14 @@ func (h *QueueHandler) HandlePostPreview(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	subtitles := <-subtitlesDone
+
 	submitPreview(
 		video.title,
 		songURL,
 		lyricsURL,
 		video.thumbnail,
-		video.duration,
+		subtitles,
 	).Render(r.Context(), w)
 }
 
@@ -134,13 +174,41 @@ func checkURL(s string) bool {
 	return u.Scheme == "http" || u.Scheme == "https"
 }
 
+// checkSubtitle makes sure a requested subtitle track is one the preview
+// offers for the video.
+func (h *QueueHandler) checkSubtitle(ctx context.Context, vidURL string, sub Subtitle) error {
+	if sub.Language == "" {
+		return nil
+	}
+
+	tracks, err := probeSubtitles(ctx, vidURL)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(listSubtitleTracks(tracks, h.subtitleLanguages), sub) {
+		return errNoSubtitle
+	}
+
+	return nil
+}
+
 func (h *QueueHandler) HandlePostSubmission(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(userKey).(User)
+	if err := h.moderation.CheckRequest(user.ID); err != nil {
+		submissionError(err).Render(r.Context(), w)
+		return
+	}
+
+	if !user.Can(PermRequest) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	title := r.FormValue("title")
 	songURL := r.FormValue("url")
 	lyricsURL := r.FormValue("lyricsURL")
-	durationString := r.FormValue("duration")
-	thumbnail := r.FormValue("thumbnailURL")
+	subtitle := parseSubtitle(r.FormValue("subtitle"))
 
 	if !checkURL(songURL) {
 		http.Error(w, "invalid URL", http.StatusBadRequest)
@@ -162,24 +230,51 @@ func (h *QueueHandler) HandlePostSubmission(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	duration, err := time.ParseDuration(durationString)
+	key, err := parseKey(r.FormValue("key"))
 	if err != nil {
-		http.Error(w, "invalid duration", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	speed, err := parseSpeed(r.FormValue("speed"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the duration counts towards queue limits and the thumbnail is fetched
+	// by the server for the intermission card, so they are looked up again
+	// rather than taken from the form
+	video, err := getVideoInfo(r.Context(), songURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	switch err := h.checkSubtitle(r.Context(), songURL, subtitle); {
+	case errors.Is(err, errNoSubtitle):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 
 	song := Song{
-		Requester: user,
-		Title:     title,
-		URL:       songURL,
-		Duration:  duration,
-		LyricsURL: sql.NullString{String: lyricsURL, Valid: lyricsURL != ""},
-		Thumbnail: thumbnail,
+		Requester:    user,
+		Title:        title,
+		URL:          songURL,
+		Duration:     video.duration,
+		LyricsURL:    sql.NullString{String: lyricsURL, Valid: lyricsURL != ""},
+		Subtitle:     subtitle,
+		Key:          key,
+		Speed:        speed,
+		ReduceVocals: r.FormValue("reduceVocals") == "true",
+		Thumbnail:    video.thumbnail,
 	}
 
-	ok := h.queue.Push(song)
-	if !ok {
-		fmt.Fprint(w, "<span class=\"p-2\">You must wait for your song to be played before submitting another.</span>")
+	if _, err := h.queue.Push(song); err != nil {
+		submissionError(err).Render(r.Context(), w)
 		return
 	}
 
@@ -187,6 +282,10 @@ func (h *QueueHandler) HandlePostSubmission(w http.ResponseWriter, r *http.Reque
 	w.WriteHeader(http.StatusSeeOther)
 }
 
+// sseWriteTimeout is how long a client may take to accept an event before it
+// is disconnected.
+const sseWriteTimeout = 10 * time.Second
+
 func (h *QueueHandler) HandleSSE(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(userKey).(User)
 	contentType := strings.ToLower(r.Header.Get("Accept"))
@@ -200,60 +299,169 @@ func (h *QueueHandler) HandleSSE(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	c := make(chan queueEvent, 64)
-	t, unlock := h.renderQueueLocked(r.Context())
-	h.addListener(c)
+	rc := http.NewResponseController(w)
+	htmlBuilder := &strings.Builder{}
+
+	// Browsers send the ID of the last event they saw when reconnecting, so
+	// replay what they missed if it is still known.
+	songs, unlock := h.queue.Freeze()
+	sub, replay, ok := h.events.subscribe(r.Header.Get("Last-Event-ID"))
 	unlock()
-	defer h.removeListener(c)
+	defer func() { h.events.unsubscribe(sub) }()
 	h.incConnection(user)
 	defer h.decConnection(user)
 
-	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", RerenderQueue, t)
-	w.(http.Flusher).Flush()
-
-	htmlBuilder := &strings.Builder{}
+	rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+	if ok {
+		for _, event := range replay {
+			h.writeEvent(r.Context(), w, user, event, htmlBuilder)
+		}
+	} else {
+		h.writeEvent(r.Context(), w, user, queueEvent{ID: sub.lastID, Event: RerenderQueue, Songs: songs}, htmlBuilder)
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
 
 	for {
 		select {
 		case <-r.Context().Done():
 			return
-		case event := <-c:
-			switch event.Event {
-			case AppendQueue:
-				htmlBuilder.Reset()
-				songRow(event.Song).Render(r.Context(), htmlBuilder)
-				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", AppendQueue, htmlBuilder.String())
-				fmt.Fprint(w, "event: queue:change\ndata:\n\n")
-			case RemoveQueue:
-				fmt.Fprintf(w, "event: %s:%d\ndata:\n\n", RemoveQueue, event.SongID)
-				fmt.Fprint(w, "event: queue:change\ndata:\n\n")
-			case SessionJoin:
-				fmt.Fprintf(w, "event: %s\ndata:%s\n\n", SessionJoin, event.User.ID)
-			case SessionLeave:
-				fmt.Printf("event: %s\ndata:%s\n\n", SessionJoin, event.User.ID)
-				fmt.Fprintf(w, "event: %s\ndata:%s\n\n", SessionJoin, event.User.ID)
-			}
-			w.(http.Flusher).Flush()
+		case <-sub.lagged:
+			// The client missed events, start over from the current queue.
+			songs, unlock := h.queue.Freeze()
+			sub, _, _ = h.events.subscribe("")
+			unlock()
+			rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+			h.writeEvent(r.Context(), w, user, queueEvent{ID: sub.lastID, Event: RerenderQueue, Songs: songs}, htmlBuilder)
+		case event := <-sub.events:
+			rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+			h.writeEvent(r.Context(), w, user, event, htmlBuilder)
+		}
+
+		// clients that stop reading hit the write deadline and are disconnected
+		if err := rc.Flush(); err != nil {
+			return
 		}
 	}
 }
 
+// writeEvent writes an event for a user in server-sent events format, with
+// its ID so the client can resume from it.
+func (h *QueueHandler) writeEvent(ctx context.Context, w io.Writer, user User, event queueEvent, htmlBuilder *strings.Builder) {
+	if event.Event == SingerCall && event.Song.Requester.ID != user.ID {
+		return
+	}
+
+	fmt.Fprintf(w, "id: %s\n", event.ID)
+
+	switch event.Event {
+	case AppendQueue:
+		htmlBuilder.Reset()
+		songRow(event.Song).Render(ctx, htmlBuilder)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", AppendQueue, htmlBuilder.String())
+		fmt.Fprint(w, "event: queue:change\ndata:\n\n")
+	case RerenderQueue:
+		htmlBuilder.Reset()
+		queueTable(event.Songs).Render(ctx, htmlBuilder)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", RerenderQueue, htmlBuilder.String())
+		fmt.Fprint(w, "event: queue:change\ndata:\n\n")
+	case SingerCall:
+		htmlBuilder.Reset()
+		singerCall(event.Song, event.Wait).Render(ctx, htmlBuilder)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", SingerCall, htmlBuilder.String())
+	case UpdateQueue:
+		htmlBuilder.Reset()
+		songCard(event.Song).Render(ctx, htmlBuilder)
+		fmt.Fprintf(w, "event: %s:%d\ndata: %s\n\n", UpdateQueue, event.Song.ID, htmlBuilder.String())
+		fmt.Fprint(w, "event: queue:change\ndata:\n\n")
+	case RemoveQueue:
+		fmt.Fprintf(w, "event: %s:%d\ndata:\n\n", RemoveQueue, event.SongID)
+		fmt.Fprint(w, "event: queue:change\ndata:\n\n")
+	case SessionJoin:
+		fmt.Fprintf(w, "event: %s\ndata:%s\n\n", SessionJoin, event.User.ID)
+	case SessionLeave:
+		fmt.Fprintf(w, "event: %s\ndata:%s\n\n", SessionLeave, event.User.ID)
+	case Reaction:
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", Reaction, event.Emoji)
+	case PlaybackStart, PlaybackEnd:
+		fmt.Fprintf(w, "event: %s\ndata: %d\n\n", event.Event, event.Song.ID)
+	}
+}
+
+// canRevoke reports whether a user may remove or skip a song.
+func canRevoke(user User, song Song) bool {
+	return user.Can(PermRevokeAny) || (song.Requester.ID == user.ID && user.Can(PermSkipOwn))
+}
+
+// revoke removes a queued song if the user may.
+func (h *QueueHandler) revoke(user User, id int) error {
+	songs := h.queue.List()
+	i := slices.IndexFunc(songs, func(s Song) bool { return s.ID == id })
+	if i >= 0 && !canRevoke(user, songs[i]) {
+		return errUnauthorized
+	}
+
+	if !h.queue.Revoke(id) {
+		return errSongNotFound
+	}
+
+	return nil
+}
+
 func (h *QueueHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(userKey).(User)
-	if !user.Admin {
+
+	idString := r.PathValue("id")
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		http.Error(w, "invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	switch err := h.revoke(user, id); {
+	case errors.Is(err, errUnauthorized):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMove moves a queued song one place up or down.
+func (h *QueueHandler) HandleMove(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermReorder) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	idString := r.PathValue("id")
-	id, err := strconv.Atoi(idString)
+	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
 		http.Error(w, "invalid ID", http.StatusBadRequest)
 		return
 	}
 
-	ok := h.queue.Revoke(id)
-	if !ok {
+	i := slices.IndexFunc(h.queue.List(), func(s Song) bool { return s.ID == id })
+	if i < 0 {
+		http.Error(w, "song not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.FormValue("direction") {
+	case "up":
+		i--
+	case "down":
+		i++
+	default:
+		http.Error(w, "invalid direction", http.StatusBadRequest)
+		return
+	}
+
+	if !h.queue.Move(id, i) {
 		http.Error(w, "song not found", http.StatusNotFound)
 		return
 	}
@@ -261,6 +469,262 @@ func (h *QueueHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errSongNotFound = errors.New("song not found")
+	errNotPlaying   = errors.New("song not playing")
+	errNoSubtitle   = errors.New("the video has no such subtitles")
+)
+
+// skip stops the song with the given ID if it is playing and the user may.
+func (h *QueueHandler) skip(user User, id int) error {
+	song, ok := h.queue.LastDequeued()
+	if !ok || song.ID != id {
+		return errNotPlaying
+	}
+
+	if !canRevoke(user, song) {
+		return errUnauthorized
+	}
+
+	// the song may still be waiting for its singer to be ready
+	if h.readiness.Cancel(song) {
+		return nil
+	}
+
+	return h.player.Stop(song)
+}
+
+// HandleSkip stops the currently playing song.
+func (h *QueueHandler) HandleSkip(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	switch err := h.skip(user, id); {
+	case errors.Is(err, errNotPlaying):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errUnauthorized):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+var (
+	errKeyRange   = fmt.Errorf("key must be between %d and %d", MinKey, MaxKey)
+	errSpeedRange = fmt.Errorf("speed must be between %.2f and %.2f", MinSpeed, MaxSpeed)
+)
+
+func validKey(key int) bool {
+	return key >= MinKey && key <= MaxKey
+}
+
+func validSpeed(speed float64) bool {
+	return speed >= MinSpeed && speed <= MaxSpeed
+}
+
+func parseKey(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	key, err := strconv.Atoi(s)
+	if err != nil || !validKey(key) {
+		return 0, errKeyRange
+	}
+
+	return key, nil
+}
+
+func parseSpeed(s string) (float64, error) {
+	if s == "" {
+		return 1, nil
+	}
+
+	speed, err := strconv.ParseFloat(s, 64)
+	if err != nil || !validSpeed(speed) {
+		return 0, errSpeedRange
+	}
+
+	return speed, nil
+}
+
+// playbackAdjustment holds playback settings sent as JSON or a form, those
+// left out are kept as they are.
+type playbackAdjustment struct {
+	Key          *int     `json:"key"`
+	Speed        *float64 `json:"speed"`
+	ReduceVocals *bool    `json:"reduceVocals"`
+}
+
+func (a playbackAdjustment) updates() ([]func(*Song), error) {
+	var updates []func(*Song)
+
+	if a.Key != nil {
+		key := *a.Key
+		if !validKey(key) {
+			return nil, errKeyRange
+		}
+		updates = append(updates, func(s *Song) { s.Key = key })
+	}
+
+	if a.Speed != nil {
+		speed := *a.Speed
+		if !validSpeed(speed) {
+			return nil, errSpeedRange
+		}
+		updates = append(updates, func(s *Song) { s.Speed = speed })
+	}
+
+	if a.ReduceVocals != nil {
+		reduceVocals := *a.ReduceVocals
+		updates = append(updates, func(s *Song) { s.ReduceVocals = reduceVocals })
+	}
+
+	return updates, nil
+}
+
+// formAdjustment reads a playbackAdjustment from a form.
+func formAdjustment(form url.Values) (playbackAdjustment, error) {
+	var a playbackAdjustment
+
+	if form.Has("key") {
+		key, err := parseKey(form.Get("key"))
+		if err != nil {
+			return a, err
+		}
+		a.Key = &key
+	}
+
+	if form.Has("speed") {
+		speed, err := parseSpeed(form.Get("speed"))
+		if err != nil {
+			return a, err
+		}
+		a.Speed = &speed
+	}
+
+	// checkboxes are preceded by a hidden input so that unchecking them is
+	// submitted too; the last value wins
+	if values := form["reduceVocals"]; len(values) > 0 {
+		reduceVocals := values[len(values)-1] == "true"
+		a.ReduceVocals = &reduceVocals
+	}
+
+	return a, nil
+}
+
+// adjust applies playback changes to a queued or currently playing song.
+func (h *QueueHandler) adjust(id int, updates []func(*Song)) error {
+	song, ok := h.queue.Update(id, func(s *Song) {
+		for _, update := range updates {
+			update(s)
+		}
+	})
+
+	if !ok {
+		return errSongNotFound
+	}
+
+	if err := h.player.Apply(song); err != nil {
+		log.Println("error applying playback change:", err)
+	}
+
+	return nil
+}
+
+// HandleAdjustPlayback changes the playback settings present in the form of a
+// queued or currently playing song.
+func (h *QueueHandler) HandleAdjustPlayback(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermPlaybackControl) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+
+	adjustment, err := formAdjustment(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updates, err := adjustment.updates()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.adjust(id, updates); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *QueueHandler) HandleReady(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+
+	if !h.readiness.Confirm(user) {
+		fmt.Fprint(w, "<span>It is not your turn right now.</span>")
+		return
+	}
+
+	fmt.Fprint(w, "<span>Thanks, enjoy your song!</span>")
+}
+
+func (h *QueueHandler) HandleReadinessSettings(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermPlaybackControl) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	readinessSettings(h.readiness.Config()).Render(r.Context(), w)
+}
+
+func (h *QueueHandler) HandlePostReadinessSettings(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermPlaybackControl) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	seconds, err := strconv.Atoi(r.FormValue("timeout"))
+	if err != nil || seconds < 0 {
+		http.Error(w, "invalid timeout", http.StatusBadRequest)
+		return
+	}
+
+	action, err := ParseReadinessAction(r.FormValue("action"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config := ReadinessConfig{Timeout: time.Duration(seconds) * time.Second, Action: action}
+	h.readiness.SetConfig(config)
+	readinessSettings(config).Render(r.Context(), w)
+}
+
 func (h *QueueHandler) HandleCurrentSong(w http.ResponseWriter, r *http.Request) {
 	lastDequeud, ok := h.queue.LastDequeued()
 
@@ -273,11 +737,21 @@ func (h *QueueHandler) HandleCurrentSong(w http.ResponseWriter, r *http.Request)
 	currentlyPlaying(&lastDequeud, false).Render(r.Context(), w)
 }
 
+// incConnection counts a new event stream of a user. Their permissions may
+// have changed since their other streams connected, so they are counted by ID.
 func (h *QueueHandler) incConnection(u User) {
 	h.connectionsMu.Lock()
 	defer h.connectionsMu.Unlock()
-	h.connections[u]++
-	if h.connections[u] == 1 {
+
+	c, ok := h.connections[u.ID]
+	if !ok {
+		c = &connection{}
+		h.connections[u.ID] = c
+	}
+	c.user = u
+	c.count++
+
+	if !ok {
 		h.sendEvent(queueEvent{Event: SessionJoin, User: u})
 	}
 }
@@ -285,25 +759,39 @@ func (h *QueueHandler) incConnection(u User) {
 func (h *QueueHandler) decConnection(u User) {
 	h.connectionsMu.Lock()
 	defer h.connectionsMu.Unlock()
-	h.connections[u]--
-	if h.connections[u] == 0 {
-		h.sendEvent(queueEvent{Event: SessionLeave, User: u})
+
+	c, ok := h.connections[u.ID]
+	if !ok {
+		return
+	}
+
+	c.count--
+	if c.count == 0 {
+		delete(h.connections, u.ID)
+		h.sendEvent(queueEvent{Event: SessionLeave, User: c.user})
 	}
 }
 
-func (h *QueueHandler) HandleMemberList(w http.ResponseWriter, r *http.Request) {
+// connectedUsers returns every user with an event stream open.
+func (h *QueueHandler) connectedUsers() []User {
 	h.connectionsMu.RLock()
 	defer h.connectionsMu.RUnlock()
-	sessions := h.connections
+
+	users := make([]User, 0, len(h.connections))
+	for _, c := range h.connections {
+		users = append(users, c.user)
+	}
+	return users
+}
+
+// members lists the connected users who are not hidden, sorted by name.
+func (h *QueueHandler) members() []Member {
+	users := h.connectedUsers()
 	queue := h.queue.List()
-	members := make([]Member, 0, len(sessions))
-
-	for u := range sessions {
-		if u.Admin {
-			members = append(members, Member{
-				User:      u,
-				QueueOpen: true,
-			})
+	members := make([]Member, 0, len(users))
+
+	for _, u := range users {
+		if s, ok := h.moderation.Get(u.ID); ok && s.Hidden {
 			continue
 		}
 
@@ -314,11 +802,119 @@ func (h *QueueHandler) HandleMemberList(w http.ResponseWriter, r *http.Request)
 			}
 		}
 
+		limits, override := h.queue.UserLimits(u.ID)
 		members = append(members, Member{
 			User:      u,
-			QueueOpen: count < h.maxUserQueueSize,
+			QueueOpen: h.queue.CheckLimits(u, 0) == nil,
+			Queued:    count,
+			Limits:    limits,
+			Override:  override,
 		})
 	}
 
-	membersList(members).Render(r.Context(), w)
+	slices.SortFunc(members, func(a, b Member) int { return strings.Compare(a.Name, b.Name) })
+	return members
+}
+
+func (h *QueueHandler) HandleMemberList(w http.ResponseWriter, r *http.Request) {
+	membersList(h.members()).Render(r.Context(), w)
+}
+
+func parseLimits(r *http.Request) (QueueLimits, error) {
+	var values [3]int
+
+	for i, name := range []string{"songs", "minutes", "perHour"} {
+		v, err := strconv.Atoi(r.FormValue(name))
+		if err != nil || v < 0 {
+			return QueueLimits{}, fmt.Errorf("invalid %s", name)
+		}
+		values[i] = v
+	}
+
+	return QueueLimits{
+		Songs:    values[0],
+		Duration: time.Duration(values[1]) * time.Minute,
+		PerHour:  values[2],
+	}, nil
+}
+
+func (h *QueueHandler) renderQueueLimits(w http.ResponseWriter, r *http.Request) {
+	members := h.connectedUsers()
+	slices.SortFunc(members, func(a, b User) int { return strings.Compare(a.Name, b.Name) })
+	overrides := h.queue.Overrides()
+	slices.SortFunc(overrides, func(a, b UserLimits) int { return strings.Compare(a.User.Name, b.User.Name) })
+
+	queueLimitsSettings(h.queue.Limits(), overrides, members).Render(r.Context(), w)
+}
+
+func (h *QueueHandler) HandleQueueLimits(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermManageUsers) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	h.renderQueueLimits(w, r)
+}
+
+func (h *QueueHandler) HandlePostQueueLimits(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermManageUsers) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limits, err := parseLimits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.queue.SetLimits(limits)
+	h.sendEvent(queueEvent{Event: RerenderQueue, Songs: h.queue.List()})
+	h.renderQueueLimits(w, r)
+}
+
+// HandlePostUserLimits gives a connected user their own limits.
+func (h *QueueHandler) HandlePostUserLimits(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermManageUsers) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limits, err := parseLimits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.connectionsMu.RLock()
+	c, found := h.connections[r.FormValue("user")]
+	var target User
+	if found {
+		target = c.user
+	}
+	h.connectionsMu.RUnlock()
+
+	if !found {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	h.queue.SetUserLimits(target, limits)
+	h.sendEvent(queueEvent{Event: RerenderQueue, Songs: h.queue.List()})
+	h.renderQueueLimits(w, r)
+}
+
+func (h *QueueHandler) HandleDeleteUserLimits(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(PermManageUsers) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	h.queue.ClearUserLimits(r.PathValue("id"))
+	h.sendEvent(queueEvent{Event: RerenderQueue, Songs: h.queue.List()})
+	h.renderQueueLimits(w, r)
 }
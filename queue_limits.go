@@ -0,0 +1,182 @@
+package mpvwebkaraoke
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// QueueLimits restricts how much a user may have in the queue.
+type QueueLimits struct {
+	// Songs is how many songs may be queued at once.
+	Songs int
+	// Duration is the total playback time that may be queued at once,
+	// unlimited if zero.
+	Duration time.Duration
+	// PerHour is how many songs may be requested within an hour, unlimited
+	// if zero.
+	PerHour int
+}
+
+// UserLimits overrides the queue limits of one user.
+type UserLimits struct {
+	User   User
+	Limits QueueLimits
+}
+
+var (
+	ErrSongLimit     = errors.New("you must wait for your song to be played before submitting another")
+	ErrDurationLimit = errors.New("you have queued too much time, wait for your songs to be played")
+	ErrHourlyLimit   = errors.New("you have requested too many songs in the last hour")
+)
+
+// recoverLimits restores the limits of individual users. The limits for
+// everyone always start from the configured ones.
+func (q *Queue) recoverLimits() error {
+	file, err := os.Open("limits.gob")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return gob.NewDecoder(file).Decode(&q.overrides)
+}
+
+func (q *Queue) persistLimits() error {
+	tempFile, err := os.CreateTemp("", "limits.*.gob")
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(tempFile).Encode(q.overrides); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), "limits.gob")
+}
+
+func (q *Queue) Limits() QueueLimits {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.limits
+}
+
+func (q *Queue) SetLimits(limits QueueLimits) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limits = limits
+}
+
+// Overrides returns the users with their own limits.
+func (q *Queue) Overrides() []UserLimits {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	overrides := make([]UserLimits, 0, len(q.overrides))
+	for _, o := range q.overrides {
+		overrides = append(overrides, o)
+	}
+	return overrides
+}
+
+func (q *Queue) SetUserLimits(user User, limits QueueLimits) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.overrides[user.ID] = UserLimits{User: user, Limits: limits}
+}
+
+func (q *Queue) ClearUserLimits(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.overrides, id)
+}
+
+// UserLimits returns the limits that apply to a user, and whether they are
+// their own.
+func (q *Queue) UserLimits(id string) (QueueLimits, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.userLimitsLocked(id)
+}
+
+func (q *Queue) userLimitsLocked(id string) (QueueLimits, bool) {
+	if o, ok := q.overrides[id]; ok {
+		return o.Limits, true
+	}
+	return q.limits, false
+}
+
+// CheckLimits reports why the user could not queue a song of the given
+// duration, or nil if they can.
+func (q *Queue) CheckLimits(user User, duration time.Duration) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.checkLimitsLocked(user, duration)
+}
+
+func (q *Queue) checkLimitsLocked(user User, duration time.Duration) error {
+	if user.Can(PermUnlimitedQueue) {
+		return nil
+	}
+
+	limits, _ := q.userLimitsLocked(user.ID)
+
+	var (
+		count  int
+		queued time.Duration
+	)
+
+	for _, s := range q.current {
+		if s.Requester.ID == user.ID {
+			count++
+			queued += s.PlaybackDuration()
+		}
+	}
+
+	if count >= limits.Songs {
+		return ErrSongLimit
+	}
+
+	if limits.Duration > 0 && queued+duration > limits.Duration {
+		return fmt.Errorf("%w (%s of %s)", ErrDurationLimit, queued.Round(time.Second), limits.Duration)
+	}
+
+	if limits.PerHour > 0 && q.requestsInLastHourLocked(user.ID) >= limits.PerHour {
+		return ErrHourlyLimit
+	}
+
+	return nil
+}
+
+func (q *Queue) requestsInLastHourLocked(id string) int {
+	count := 0
+	for _, t := range q.requests[id] {
+		if time.Since(t) < time.Hour {
+			count++
+		}
+	}
+	return count
+}
+
+// recordRequestLocked remembers when a user requested a song, forgetting
+// requests older than an hour.
+func (q *Queue) recordRequestLocked(id string) {
+	now := time.Now()
+	requests := q.requests[id][:0]
+	for _, t := range q.requests[id] {
+		if now.Sub(t) < time.Hour {
+			requests = append(requests, t)
+		}
+	}
+	q.requests[id] = append(requests, now)
+}
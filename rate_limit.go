@@ -0,0 +1,192 @@
+package mpvwebkaraoke
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit allows Count events per Interval, all of which may happen at once.
+// A zero limit allows everything.
+type RateLimit struct {
+	Count    int
+	Interval time.Duration
+}
+
+// ParseRateLimit parses a limit written as count/interval, such as 5/1m, or 0
+// for no limit.
+func ParseRateLimit(s string) (RateLimit, error) {
+	if s == "0" || s == "" {
+		return RateLimit{}, nil
+	}
+
+	count, interval, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected count/interval", s)
+	}
+
+	var (
+		l   RateLimit
+		err error
+	)
+
+	if l.Count, err = strconv.Atoi(count); err != nil || l.Count <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit count %q", count)
+	}
+
+	if l.Interval, err = time.ParseDuration(interval); err != nil || l.Interval <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit interval %q", interval)
+	}
+
+	return l, nil
+}
+
+func (l RateLimit) newLimiter() *rate.Limiter {
+	if l.Count == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Every(l.Interval/time.Duration(l.Count)), l.Count)
+}
+
+type userLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter limits how often each user, or each IP address, and everyone
+// together may do something.
+type RateLimiter struct {
+	perUser RateLimit
+	global  *rate.Limiter
+	mu      sync.Mutex
+	users   map[string]*userLimiter
+	pruned  time.Time
+}
+
+func NewRateLimiter(perUser, global RateLimit) *RateLimiter {
+	return &RateLimiter{
+		perUser: perUser,
+		global:  global.newLimiter(),
+		users:   make(map[string]*userLimiter),
+		pruned:  time.Now(),
+	}
+}
+
+// reserve takes a token from the user's and the global bucket. If either is
+// empty neither is taken, and it returns how long to wait.
+func reserve(now time.Time, limiters ...*rate.Limiter) time.Duration {
+	reservations := make([]*rate.Reservation, 0, len(limiters))
+	var wait time.Duration
+
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		r := l.ReserveN(now, 1)
+		reservations = append(reservations, r)
+		wait = max(wait, r.DelayFrom(now))
+	}
+
+	if wait > 0 {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+
+	return wait
+}
+
+// Allow reports how long whoever the key stands for, usually a user ID, has to
+// wait before they may go ahead, or zero if they may now.
+func (l *RateLimiter) Allow(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	// forget users who have not been limited in a while
+	if now.Sub(l.pruned) > time.Hour {
+		for id, u := range l.users {
+			if now.Sub(u.lastSeen) > time.Hour {
+				delete(l.users, id)
+			}
+		}
+		l.pruned = now
+	}
+
+	u, ok := l.users[key]
+	if !ok {
+		u = &userLimiter{limiter: l.perUser.newLimiter()}
+		l.users[key] = u
+	}
+	u.lastSeen = now
+
+	return reserve(now, u.limiter, l.global)
+}
+
+// clientIP returns the address a request came from. Behind a reverse proxy on
+// a unix socket it is the one the proxy added to X-Forwarded-For, ngrok
+// already passes on the client's address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil && host != "" {
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+		return ip
+	}
+
+	return r.RemoteAddr
+}
+
+// Wrap responds with 429 Too Many Requests when the user is over the limit.
+// htmx requests get a message swapped into the form's #error element.
+func (l *RateLimiter) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return l.wrap(next, func(r *http.Request) string {
+		return r.Context().Value(userKey).(User).ID
+	})
+}
+
+// WrapIP is like Wrap but limits each IP address, for requests made before
+// logging in.
+func (l *RateLimiter) WrapIP(next http.HandlerFunc) http.HandlerFunc {
+	return l.wrap(next, func(r *http.Request) string {
+		return "ip:" + clientIP(r)
+	})
+}
+
+func (l *RateLimiter) wrap(next http.HandlerFunc, key func(*http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wait := l.Allow(key(r))
+		if wait <= 0 {
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+
+		if isAPIRequest(r) {
+			writeAPIError(w, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+
+		if r.Header.Get("HX-Request") == "" {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		w.Header().Set("HX-Retarget", "#error")
+		w.Header().Set("HX-Reswap", "innerHTML")
+		w.WriteHeader(http.StatusTooManyRequests)
+		rateLimited(wait).Render(r.Context(), w)
+	}
+}
@@ -0,0 +1,164 @@
+package mpvwebkaraoke
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReadinessAction is what happens to a song whose singer did not confirm in time.
+type ReadinessAction string
+
+const (
+	ReadinessPlay     ReadinessAction = "play"
+	ReadinessSkip     ReadinessAction = "skip"
+	ReadinessMoveDown ReadinessAction = "move-down"
+)
+
+func ParseReadinessAction(s string) (ReadinessAction, error) {
+	switch a := ReadinessAction(s); a {
+	case ReadinessPlay, ReadinessSkip, ReadinessMoveDown:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown readiness action %q", s)
+	}
+}
+
+type ReadinessConfig struct {
+	// Timeout is how long to wait for the singer to confirm. The singer is
+	// still called but playback does not wait if it is zero.
+	Timeout time.Duration
+	Action  ReadinessAction
+}
+
+// maxMoveDowns is how often a song is moved down before it is skipped, so a
+// singer who left does not hold up the queue forever.
+const maxMoveDowns = 2
+
+type CallEventHandler func(song Song, wait time.Duration)
+
+// Readiness calls singers to the mic before their song and waits for them
+// to confirm they are ready.
+type Readiness struct {
+	mu           sync.Mutex
+	config       ReadinessConfig
+	waiting      *Song
+	done         chan ReadinessAction
+	movedDown    map[int]int
+	callHandlers []CallEventHandler
+}
+
+func NewReadiness(config ReadinessConfig) *Readiness {
+	return &Readiness{config: config, movedDown: make(map[int]int)}
+}
+
+func (r *Readiness) Config() ReadinessConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config
+}
+
+func (r *Readiness) SetConfig(config ReadinessConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.config = config
+}
+
+// Await calls the singer of a song and blocks until they confirm, the song
+// is skipped or the timeout passes. It returns the action to take with the
+// song.
+func (r *Readiness) Await(song Song) ReadinessAction {
+	action := r.await(song)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if action != ReadinessMoveDown {
+		delete(r.movedDown, song.ID)
+		return action
+	}
+
+	r.movedDown[song.ID]++
+	if r.movedDown[song.ID] > maxMoveDowns {
+		delete(r.movedDown, song.ID)
+		return ReadinessSkip
+	}
+
+	return action
+}
+
+func (r *Readiness) await(song Song) ReadinessAction {
+	r.mu.Lock()
+	config := r.config
+	done := make(chan ReadinessAction, 1)
+	if config.Timeout > 0 {
+		r.waiting = &song
+		r.done = done
+	}
+	handlers := r.callHandlers
+	r.mu.Unlock()
+
+	for _, h := range handlers {
+		h(song, config.Timeout)
+	}
+
+	if config.Timeout <= 0 {
+		return ReadinessPlay
+	}
+
+	defer func() {
+		r.mu.Lock()
+		r.waiting = nil
+		r.done = nil
+		r.mu.Unlock()
+	}()
+
+	select {
+	case action := <-done:
+		return action
+	case <-time.After(config.Timeout):
+		return config.Action
+	}
+}
+
+// finish ends waiting for the song with the given action. It must be called
+// with the lock held.
+func (r *Readiness) finish(action ReadinessAction) {
+	r.done <- action
+	r.waiting = nil
+	r.done = nil
+}
+
+// Confirm marks the awaited song as ready if the user requested it or may
+// control playback.
+func (r *Readiness) Confirm(user User) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.waiting == nil || (r.waiting.Requester.ID != user.ID && !user.Can(PermPlaybackControl)) {
+		return false
+	}
+
+	r.finish(ReadinessPlay)
+	return true
+}
+
+// Cancel stops waiting for the singer of a song so it is skipped, reporting
+// false if the song is not being waited for.
+func (r *Readiness) Cancel(song Song) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.waiting == nil || r.waiting.ID != song.ID {
+		return false
+	}
+
+	r.finish(ReadinessSkip)
+	return true
+}
+
+func (r *Readiness) OnCall(h CallEventHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.callHandlers = append(r.callHandlers, h)
+}
@@ -0,0 +1,112 @@
+package mpvwebkaraoke
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"image"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+type RoomPINConfig struct {
+	// PIN is used as is if set, otherwise a random PIN of Length digits is
+	// generated and replaced every Interval.
+	PIN      string
+	Length   int
+	Interval time.Duration
+	// BaseURL is the public URL guests join at.
+	BaseURL string
+}
+
+// RoomPIN is the PIN guests enter to join the room. The previous PIN stays
+// valid for one interval so a code scanned just before rotating still works.
+type RoomPIN struct {
+	config   RoomPINConfig
+	mu       sync.RWMutex
+	pin      string
+	previous string
+}
+
+func NewRoomPIN(config RoomPINConfig) *RoomPIN {
+	p := &RoomPIN{config: config, pin: config.PIN}
+	if p.pin == "" {
+		p.pin = randomPIN(config.Length)
+	}
+	return p
+}
+
+func randomPIN(length int) string {
+	pin := strings.Builder{}
+	for range length {
+		n, _ := rand.Int(rand.Reader, big.NewInt(10))
+		pin.WriteByte(byte('0' + n.Int64()))
+	}
+	return pin.String()
+}
+
+// Start rotates a generated PIN until the context is cancelled.
+func (p *RoomPIN) Start(ctx context.Context) {
+	if p.config.PIN != "" || p.config.Interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(p.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.Rotate()
+			}
+		}
+	}()
+}
+
+// Rotate replaces the PIN with a new random one.
+func (p *RoomPIN) Rotate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.previous = p.pin
+	p.pin = randomPIN(max(p.config.Length, len(p.pin)))
+}
+
+func (p *RoomPIN) PIN() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pin
+}
+
+func (p *RoomPIN) Check(pin string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if subtle.ConstantTimeCompare([]byte(pin), []byte(p.pin)) == 1 {
+		return true
+	}
+
+	return p.previous != "" && subtle.ConstantTimeCompare([]byte(pin), []byte(p.previous)) == 1
+}
+
+// JoinURL is the login page with the current PIN filled in.
+func (p *RoomPIN) JoinURL() string {
+	return strings.TrimSuffix(p.config.BaseURL, "/") + "/auth?" + url.Values{"pin": {p.PIN()}}.Encode()
+}
+
+// QRCode encodes the join URL as a square image of the given size in pixels.
+func (p *RoomPIN) QRCode(size int) (image.Image, error) {
+	code, err := qrcode.New(p.JoinURL(), qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+
+	return code.Image(size), nil
+}
@@ -0,0 +1,260 @@
+package mpvwebkaraoke
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/wader/goutubedl"
+)
+
+// Subtitle identifies a subtitle track of a video by language and whether
+// it was generated automatically.
+type Subtitle struct {
+	Language  string
+	Automatic bool
+}
+
+func (s Subtitle) String() string {
+	if s.Automatic {
+		return s.Language + " (auto)"
+	}
+	return s.Language
+}
+
+// formValue encodes the subtitle for use in a form, see parseSubtitle.
+func (s Subtitle) formValue() string {
+	if s.Automatic {
+		return "auto:" + s.Language
+	}
+	return s.Language
+}
+
+func parseSubtitle(value string) Subtitle {
+	if lang, ok := strings.CutPrefix(value, "auto:"); ok {
+		return Subtitle{Language: lang, Automatic: true}
+	}
+	return Subtitle{Language: value}
+}
+
+type subtitleTrack struct {
+	Subtitle
+	URL string
+	Ext string
+}
+
+type subtitleFormat struct {
+	URL string `json:"url"`
+	Ext string `json:"ext"`
+}
+
+type subtitleInfo struct {
+	Subtitles         map[string][]subtitleFormat `json:"subtitles"`
+	AutomaticCaptions map[string][]subtitleFormat `json:"automatic_captions"`
+}
+
+// probeSubtitles lists the subtitle tracks of a video in VTT format, including
+// automatically generated captions. goutubedl does not expose the latter.
+func probeSubtitles(ctx context.Context, vidURL string) (tracks []subtitleTrack, err error) {
+	cmd := exec.CommandContext(ctx, goutubedl.Path,
+		"--dump-single-json",
+		"--skip-download",
+		"--no-playlist",
+		"--",
+		vidURL,
+	)
+
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+
+	if err = cmd.Run(); err != nil {
+		err = fmt.Errorf("failed to probe subtitles: %w", err)
+		return
+	}
+
+	var info subtitleInfo
+	if err = json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		err = fmt.Errorf("failed to decode subtitle info: %w", err)
+		return
+	}
+
+	collect := func(formats map[string][]subtitleFormat, automatic bool) {
+		for lang, fs := range formats {
+			for _, f := range fs {
+				if f.Ext == "vtt" {
+					tracks = append(tracks, subtitleTrack{
+						Subtitle: Subtitle{Language: lang, Automatic: automatic},
+						URL:      f.URL,
+						Ext:      f.Ext,
+					})
+					break
+				}
+			}
+		}
+	}
+
+	collect(info.Subtitles, false)
+	collect(info.AutomaticCaptions, true)
+	return
+}
+
+// selectSubtitleTrack picks the chosen track if there is one, and otherwise the
+// first track matching the preferred languages, favouring uploaded subtitles
+// over automatic captions.
+func selectSubtitleTrack(tracks []subtitleTrack, chosen Subtitle, languages []string) (subtitleTrack, bool) {
+	for _, t := range tracks {
+		if chosen.Language != "" && t.Subtitle == chosen {
+			return t, true
+		}
+	}
+
+	for _, automatic := range []bool{false, true} {
+		for _, lang := range languages {
+			for _, t := range tracks {
+				if t.Automatic == automatic && t.Language == lang {
+					return t, true
+				}
+			}
+		}
+	}
+
+	return subtitleTrack{}, false
+}
+
+// listSubtitleTracks returns the uploaded tracks and the automatic captions in
+// the preferred languages, with preferred languages first.
+func listSubtitleTracks(tracks []subtitleTrack, languages []string) []Subtitle {
+	subs := make([]Subtitle, 0)
+
+	for _, lang := range languages {
+		for _, automatic := range []bool{false, true} {
+			for _, t := range tracks {
+				if t.Language == lang && t.Automatic == automatic {
+					subs = append(subs, t.Subtitle)
+				}
+			}
+		}
+	}
+
+	for _, t := range tracks {
+		if !t.Automatic && !slices.Contains(languages, t.Language) {
+			subs = append(subs, t.Subtitle)
+		}
+	}
+
+	return subs
+}
+
+// SubtitleURL resolves the current download URL of a subtitle track.
+func SubtitleURL(ctx context.Context, vidURL string, sub Subtitle) (string, error) {
+	tracks, err := probeSubtitles(ctx, vidURL)
+	if err != nil {
+		return "", err
+	}
+
+	for _, t := range tracks {
+		if t.Subtitle == sub {
+			return t.URL, nil
+		}
+	}
+
+	return "", fmt.Errorf("subtitle track %s not found", sub)
+}
+
+func downloadSubtitle(ctx context.Context, subURL string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, subURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching subtitles: %s", resp.Status)
+	}
+
+	_, err = io.Copy(w, io.LimitReader(resp.Body, 4<<20))
+	return err
+}
+
+func fetchSubtitleLyrics(ctx context.Context, vidURL string, sub Subtitle, languages []string) (lyrics Lyrics, err error) {
+	tracks, err := probeSubtitles(ctx, vidURL)
+	if err != nil {
+		return
+	}
+
+	track, ok := selectSubtitleTrack(tracks, sub, languages)
+	if !ok {
+		err = errors.New("no subtitles in preferred languages")
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err = downloadSubtitle(ctx, track.URL, buf); err != nil {
+		return
+	}
+
+	lines, err := parseVTTText(buf)
+	if err != nil {
+		return
+	}
+
+	if len(lines) == 0 {
+		err = errors.New("subtitles are empty")
+		return
+	}
+
+	lyrics = Lyrics{Source: "subtitles:" + track.Language, Lines: lines}
+	return
+}
+
+var vttTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// parseVTTText returns the distinct text lines of a WebVTT file in order.
+// Automatic captions repeat each line across several cues, so lines already
+// emitted by the previous cue are skipped.
+func parseVTTText(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	lines := make([]string, 0)
+	previous := make(map[string]bool)
+	current := make(map[string]bool)
+	inCue := false
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.Contains(line, "-->"):
+			inCue = true
+			previous, current = current, make(map[string]bool)
+		case line == "":
+			inCue = false
+		case inCue:
+			text := strings.TrimSpace(vttTagPattern.ReplaceAllString(line, ""))
+			if text == "" {
+				continue
+			}
+			seen := previous[text] || current[text]
+			current[text] = true
+			if !seen {
+				lines = append(lines, text)
+			}
+		}
+	}
+
+	return lines, scanner.Err()
+}
@@ -0,0 +1,113 @@
+package mpvwebkaraoke
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// TokenHandler lets users create and revoke their API tokens. User managers
+// see and may revoke everyone's.
+type TokenHandler struct {
+	tokens *TokenStore
+}
+
+func NewTokenHandler(tokens *TokenStore) *TokenHandler {
+	return &TokenHandler{tokens: tokens}
+}
+
+// viaToken reports whether a request was made with an API token rather than
+// a login, tokens may not manage tokens.
+func viaToken(r *http.Request) bool {
+	_, ok := r.Context().Value(apiTokenKey).(string)
+	return ok
+}
+
+func (h *TokenHandler) visible(user User) []APIToken {
+	id := user.ID
+	if user.Can(PermManageUsers) {
+		id = ""
+	}
+
+	tokens := h.tokens.List(id)
+	slices.SortFunc(tokens, func(a, b APIToken) int { return b.Created.Compare(a.Created) })
+	return tokens
+}
+
+func (h *TokenHandler) renderList(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	tokenList(h.visible(user), user.Can(PermManageUsers)).Render(r.Context(), w)
+}
+
+func (h *TokenHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	tokensPage(user.Permissions).Render(r.Context(), w)
+}
+
+func (h *TokenHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	h.renderList(w, r)
+}
+
+func (h *TokenHandler) HandlePostToken(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if viaToken(r) {
+		http.Error(w, "API tokens cannot create tokens", http.StatusForbidden)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > 64 {
+		tokenError("The name must be between 1 and 64 characters.").Render(r.Context(), w)
+		return
+	}
+
+	scopes, err := ParsePermissions(strings.Join(r.Form["scope"], ","))
+	if err != nil {
+		tokenError(capitalize(err.Error())+".").Render(r.Context(), w)
+		return
+	}
+
+	if !user.Permissions.Has(scopes) {
+		tokenError("You cannot give a token permissions you do not have.").Render(r.Context(), w)
+		return
+	}
+
+	raw, _, err := h.tokens.Create(user, name, scopes)
+	if err != nil {
+		log.Println("error creating API token:", err)
+		http.Error(w, "failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("HX-Trigger", "tokens:change")
+	tokenCreated(raw).Render(r.Context(), w)
+}
+
+func (h *TokenHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if viaToken(r) {
+		http.Error(w, "API tokens cannot revoke tokens", http.StatusForbidden)
+		return
+	}
+
+	token, ok := h.tokens.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, ErrTokenNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	if token.User.ID != user.ID && !user.Can(PermManageUsers) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.tokens.Revoke(token.ID); err != nil {
+		log.Println("error revoking API token:", err)
+		http.Error(w, "failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderList(w, r)
+}
@@ -2,6 +2,7 @@ package mpvwebkaraoke
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
@@ -15,16 +16,20 @@ import (
 )
 
 type OnceCache interface {
-	Cache(context.Context, string)
+	Cache(context.Context, Song)
 	GetOrCancel(string) (string, bool)
+	GetSubtitles(string, Subtitle) (string, bool)
+	GetLoudness(string) sql.NullFloat64
 	Clear(string) error
 }
 
 type noOpCache struct{}
 
-func (noOpCache) Cache(ctx context.Context, key string) {}
-func (noOpCache) GetOrCancel(key string) (string, bool) { return "", false }
-func (noOpCache) Clear(key string) error                { return nil }
+func (noOpCache) Cache(ctx context.Context, song Song)                 {}
+func (noOpCache) GetOrCancel(key string) (string, bool)                { return "", false }
+func (noOpCache) GetSubtitles(key string, sub Subtitle) (string, bool) { return "", false }
+func (noOpCache) GetLoudness(key string) sql.NullFloat64               { return sql.NullFloat64{} }
+func (noOpCache) Clear(key string) error                               { return nil }
 
 var NullCache = OnceCache(&noOpCache{})
 
@@ -38,18 +43,23 @@ const (
 )
 
 type cacheJob struct {
-	url string
-	ctx context.Context
+	url      string
+	subtitle Subtitle
+	ctx      context.Context
 }
 
 type cacheEntry struct {
-	status cacheStatus
-	cancel context.CancelFunc
+	status       cacheStatus
+	subtitle     Subtitle
+	hasSubtitles bool
+	loudness     sql.NullFloat64
+	cancel       context.CancelFunc
 }
 
 type VideoCacheConfig struct {
-	DownloadFilter string
-	CachePath      string
+	DownloadFilter  string
+	CachePath       string
+	MeasureLoudness bool
 }
 
 type VideoCache struct {
@@ -80,8 +90,11 @@ func (cr *readerWithContext) Read(p []byte) (n int, err error) {
 	return cr.Reader.Read(p)
 }
 
-// Cache caches a video from a URL. If the video is already being cached, it does nothing.
-func (vc *VideoCache) Cache(ctx context.Context, vidURL string) {
+// Cache caches the video of a song, along with its chosen subtitle track.
+// If the video is already being cached, it does nothing, so songs of the same
+// video with other subtitles get theirs when played.
+func (vc *VideoCache) Cache(ctx context.Context, song Song) {
+	vidURL := song.URL
 	log.Println("queuing", vidURL)
 
 	vc.entriesMu.Lock()
@@ -93,7 +106,7 @@ func (vc *VideoCache) Cache(ctx context.Context, vidURL string) {
 
 	ctxCancel, cancel := context.WithCancel(ctx)
 
-	vc.entries[vidURL] = &cacheEntry{cancel: cancel, status: cacheStatusPending}
+	vc.entries[vidURL] = &cacheEntry{cancel: cancel, status: cacheStatusPending, subtitle: song.Subtitle}
 	vc.entriesMu.Unlock()
 
 	vc.queueOnce.Do(func() {
@@ -102,26 +115,53 @@ func (vc *VideoCache) Cache(ctx context.Context, vidURL string) {
 		go vc.queueWorker()
 	})
 
-	vc.queue <- cacheJob{url: vidURL, ctx: ctxCancel}
+	vc.queue <- cacheJob{url: vidURL, subtitle: song.Subtitle, ctx: ctxCancel}
 }
 
 // GetOrCache returns the path to the cached video if it is available, or cancels the download if it is pending.
+// Subtitles or loudness still being fetched for an available video are given up on, the song is about to play.
 func (vc *VideoCache) GetOrCancel(vidURL string) (string, bool) {
 	vc.entriesMu.Lock()
 	defer vc.entriesMu.Unlock()
 
 	if entry, ok := vc.entries[vidURL]; ok {
+		entry.cancel()
+
 		if entry.status == cacheStatusAvailable {
 			return vc.vidCachePath(vidURL), true
 		}
 
-		log.Println("calling cancel", vidURL)
-		entry.cancel()
+		log.Println("canceled", vidURL)
+	}
+
+	return "", false
+}
+
+// GetSubtitles returns the path to the cached subtitles of a video if the
+// track is the one that was cached and they are available.
+func (vc *VideoCache) GetSubtitles(vidURL string, sub Subtitle) (string, bool) {
+	vc.entriesMu.Lock()
+	defer vc.entriesMu.Unlock()
+
+	if entry, ok := vc.entries[vidURL]; ok && entry.status == cacheStatusAvailable && entry.hasSubtitles && entry.subtitle == sub {
+		return vc.subCachePath(vidURL), true
 	}
 
 	return "", false
 }
 
+// GetLoudness returns the integrated loudness of a cached video if it was measured.
+func (vc *VideoCache) GetLoudness(vidURL string) sql.NullFloat64 {
+	vc.entriesMu.Lock()
+	defer vc.entriesMu.Unlock()
+
+	if entry, ok := vc.entries[vidURL]; ok && entry.status == cacheStatusAvailable {
+		return entry.loudness
+	}
+
+	return sql.NullFloat64{}
+}
+
 // Clear cancels the download of a video and removes it from the cache.
 func (vc *VideoCache) Clear(vidURL string) error {
 	log.Println("clearing", vidURL)
@@ -143,9 +183,12 @@ func (vc *VideoCache) Clear(vidURL string) error {
 }
 
 func (vc *VideoCache) removeArtifacts(vidURL string) error {
-	vidPath := vc.vidCachePath(vidURL)
-	if _, err := os.Stat(vidPath); err == nil {
-		return os.Remove(vidPath)
+	for _, p := range []string{vc.vidCachePath(vidURL), vc.subCachePath(vidURL)} {
+		if _, err := os.Stat(p); err == nil {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -197,6 +240,45 @@ func (vc *VideoCache) download(ctx context.Context, vidURL string) (err error) {
 	return
 }
 
+func (vc *VideoCache) downloadSubtitles(ctx context.Context, vidURL string, sub Subtitle) error {
+	log.Println("downloading", sub, "subtitles for", vidURL)
+
+	subURL, err := SubtitleURL(ctx, vidURL, sub)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(vc.subCachePath(vidURL))
+	if err != nil {
+		return fmt.Errorf("failed to create subtitle file: %w", err)
+	}
+
+	defer file.Close()
+
+	if err := downloadSubtitle(ctx, subURL, file); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to download subtitles: %w", err)
+	}
+
+	return nil
+}
+
+func (vc *VideoCache) setSubtitlesOnExisting(key string) {
+	vc.entriesMu.Lock()
+	defer vc.entriesMu.Unlock()
+	if _, ok := vc.entries[key]; ok {
+		vc.entries[key].hasSubtitles = true
+	}
+}
+
+func (vc *VideoCache) setLoudnessOnExisting(key string, loudness float64) {
+	vc.entriesMu.Lock()
+	defer vc.entriesMu.Unlock()
+	if _, ok := vc.entries[key]; ok {
+		vc.entries[key].loudness = sql.NullFloat64{Float64: loudness, Valid: true}
+	}
+}
+
 func (vc *VideoCache) setStatusOnExisting(key string, status cacheStatus) {
 	vc.entriesMu.Lock()
 	defer vc.entriesMu.Unlock()
@@ -239,10 +321,35 @@ func (vc *VideoCache) queueWorker() {
 		}
 
 		log.Println("downloaded", job.url)
+
+		// the video can be played now, subtitles and loudness are used if
+		// they are ready in time
 		vc.setStatusOnExisting(job.url, cacheStatusAvailable)
+
+		if job.subtitle.Language != "" {
+			if err := vc.downloadSubtitles(job.ctx, job.url, job.subtitle); err != nil {
+				log.Println("subtitle download failed for", job.url, ":", err)
+			} else {
+				vc.setSubtitlesOnExisting(job.url)
+			}
+		}
+
+		if vc.config.MeasureLoudness {
+			loudness, err := measureLoudness(job.ctx, vc.vidCachePath(job.url))
+			if err != nil {
+				log.Println("loudness measurement failed for", job.url, ":", err)
+			} else {
+				log.Printf("measured %s at %.1f LUFS\n", job.url, loudness)
+				vc.setLoudnessOnExisting(job.url, loudness)
+			}
+		}
 	}
 }
 
 func (vc *VideoCache) vidCachePath(vidURL string) string {
 	return path.Join(vc.config.CachePath, url.PathEscape(vidURL))
 }
+
+func (vc *VideoCache) subCachePath(vidURL string) string {
+	return vc.vidCachePath(vidURL) + ".vtt"
+}
@@ -0,0 +1,276 @@
+package mpvwebkaraoke
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+type WebhookEvent string
+
+const (
+	WebhookQueuePush     WebhookEvent = "queue:push"
+	WebhookQueueRemove   WebhookEvent = "queue:remove"
+	WebhookPlaybackStart WebhookEvent = "playback:start"
+	WebhookPlaybackEnd   WebhookEvent = "playback:end"
+)
+
+var webhookEvents = []WebhookEvent{WebhookQueuePush, WebhookQueueRemove, WebhookPlaybackStart, WebhookPlaybackEnd}
+
+const (
+	webhookAttempts = 4
+	webhookBacklog  = 64
+	webhookLogSize  = 100
+)
+
+// WebhookConfig is an endpoint that is sent events as JSON. Events limits
+// which, every event is sent if it is empty. With a secret the body is signed
+// in the X-Karaoke-Signature header as sha256=HMAC.
+type WebhookConfig struct {
+	URL    string         `json:"url"`
+	Events []WebhookEvent `json:"events"`
+	Secret string         `json:"secret"`
+}
+
+func (c WebhookConfig) wants(event WebhookEvent) bool {
+	return len(c.Events) == 0 || slices.Contains(c.Events, event)
+}
+
+// LoadWebhookConfigs reads a JSON array of webhooks.
+func LoadWebhookConfigs(filename string) ([]WebhookConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var configs []WebhookConfig
+	if err := json.NewDecoder(file).Decode(&configs); err != nil {
+		return nil, fmt.Errorf("failed to decode webhooks: %w", err)
+	}
+
+	for _, c := range configs {
+		if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid webhook URL %q", c.URL)
+		}
+
+		for _, e := range c.Events {
+			if !slices.Contains(webhookEvents, e) {
+				return nil, fmt.Errorf("unknown webhook event %q", e)
+			}
+		}
+	}
+
+	return configs, nil
+}
+
+// webhookPayload is the body of every delivery.
+type webhookPayload struct {
+	ID     string       `json:"id"`
+	Event  WebhookEvent `json:"event"`
+	Time   time.Time    `json:"time"`
+	Song   *songJSON    `json:"song,omitempty"`
+	SongID int          `json:"songId,omitempty"`
+}
+
+// WebhookDelivery records how sending an event to a webhook went.
+type WebhookDelivery struct {
+	ID       string
+	URL      string
+	Event    WebhookEvent
+	Time     time.Time
+	Attempts int
+	Status   int
+	Error    string
+}
+
+func (d WebhookDelivery) OK() bool {
+	return d.Error == ""
+}
+
+type webhook struct {
+	config   WebhookConfig
+	payloads chan webhookPayload
+}
+
+// Webhooks sends queue and playback events to the configured webhooks. Each
+// webhook gets its events in order, retrying failed deliveries a few times.
+type Webhooks struct {
+	hooks  []*webhook
+	client *http.Client
+
+	mu  sync.Mutex
+	log []WebhookDelivery
+}
+
+func NewWebhooks(configs []WebhookConfig) *Webhooks {
+	w := &Webhooks{client: &http.Client{Timeout: 10 * time.Second}}
+	for _, c := range configs {
+		w.hooks = append(w.hooks, &webhook{config: c, payloads: make(chan webhookPayload, webhookBacklog)})
+	}
+	return w
+}
+
+// Start delivers events until the context is cancelled.
+func (w *Webhooks) Start(ctx context.Context) {
+	for _, h := range w.hooks {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case p := <-h.payloads:
+					w.record(w.deliver(ctx, h.config, p))
+				}
+			}
+		}()
+	}
+}
+
+// Configs returns the configured webhooks.
+func (w *Webhooks) Configs() []WebhookConfig {
+	configs := make([]WebhookConfig, 0, len(w.hooks))
+	for _, h := range w.hooks {
+		configs = append(configs, h.config)
+	}
+	return configs
+}
+
+// Deliveries returns the most recent deliveries, newest first.
+func (w *Webhooks) Deliveries() []WebhookDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	deliveries := slices.Clone(w.log)
+	slices.Reverse(deliveries)
+	return deliveries
+}
+
+func (w *Webhooks) record(d WebhookDelivery) {
+	if !d.OK() {
+		log.Printf("error delivering %s webhook to %s: %s", d.Event, d.URL, d.Error)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.log = append(w.log, d)
+	if len(w.log) > webhookLogSize {
+		w.log = slices.Delete(w.log, 0, len(w.log)-webhookLogSize)
+	}
+}
+
+func (w *Webhooks) send(p webhookPayload) {
+	p.ID = newState()[:16]
+	p.Time = time.Now()
+
+	for _, h := range w.hooks {
+		if !h.config.wants(p.Event) {
+			continue
+		}
+
+		// events are sent from queue and player callbacks, which must not
+		// wait for a slow webhook
+		select {
+		case h.payloads <- p:
+		default:
+			w.record(WebhookDelivery{ID: p.ID, URL: h.config.URL, Event: p.Event, Time: p.Time, Error: "dropped, too many pending deliveries"})
+		}
+	}
+}
+
+// SongEvent returns a handler sending the event with the song it is called with.
+func (w *Webhooks) SongEvent(event WebhookEvent) func(Song) {
+	return func(s Song) {
+		song := newSongJSON(s)
+		w.send(webhookPayload{Event: event, Song: &song, SongID: s.ID})
+	}
+}
+
+// RemoveEvent sends WebhookQueueRemove for a song that left the queue.
+func (w *Webhooks) RemoveEvent(id int) {
+	w.send(webhookPayload{Event: WebhookQueueRemove, SongID: id})
+}
+
+func (w *Webhooks) deliver(ctx context.Context, config WebhookConfig, p webhookPayload) WebhookDelivery {
+	d := WebhookDelivery{ID: p.ID, URL: config.URL, Event: p.Event, Time: p.Time}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+
+	backoff := time.Second
+
+	for d.Attempts < webhookAttempts {
+		if d.Attempts > 0 {
+			select {
+			case <-ctx.Done():
+				return d
+			case <-time.After(backoff):
+			}
+			backoff *= 4
+		}
+
+		d.Attempts++
+		d.Status, err = w.post(ctx, config, p, body)
+
+		switch {
+		case err != nil:
+			d.Error = err.Error()
+		case d.Status >= 300:
+			d.Error = http.StatusText(d.Status)
+		default:
+			d.Error = ""
+			return d
+		}
+
+		// the webhook will not accept it on another try
+		if d.Status >= 400 && d.Status < 500 && d.Status != http.StatusTooManyRequests {
+			return d
+		}
+	}
+
+	return d
+}
+
+func (w *Webhooks) post(ctx context.Context, config WebhookConfig, p webhookPayload, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mpvwebkaraoke")
+	req.Header.Set("X-Karaoke-Event", string(p.Event))
+	req.Header.Set("X-Karaoke-Delivery", p.ID)
+
+	if config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(config.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Karaoke-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	return resp.StatusCode, nil
+}
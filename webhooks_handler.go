@@ -0,0 +1,34 @@
+package mpvwebkaraoke
+
+import "net/http"
+
+// WebhookHandler shows admins the configured webhooks and how deliveries went.
+type WebhookHandler struct {
+	webhooks *Webhooks
+}
+
+func NewWebhookHandler(webhooks *Webhooks) *WebhookHandler {
+	return &WebhookHandler{webhooks: webhooks}
+}
+
+// Webhooks can reveal internal addresses, so only admins, who have every
+// permission, may see them.
+func (h *WebhookHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(AllPermissions) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	webhooksPage(h.webhooks.Configs()).Render(r.Context(), w)
+}
+
+func (h *WebhookHandler) HandleDeliveries(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	if !user.Can(AllPermissions) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	webhookDeliveries(h.webhooks.Deliveries()).Render(r.Context(), w)
+}
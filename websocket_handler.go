@@ -0,0 +1,277 @@
+package mpvwebkaraoke
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout = sseWriteTimeout
+	// wsPongTimeout is how long a client may stay silent, pings are sent
+	// often enough that pongs keep it alive.
+	wsPongTimeout  = time.Minute
+	wsPingInterval = wsPongTimeout / 2
+	wsMaxMessage   = 4096
+)
+
+// allowedReactions are the emoji clients can react with.
+var allowedReactions = []string{"👏", "🎉", "❤️", "😂", "🔥", "🎤"}
+
+// The default origin check refuses connections from other sites, which stands
+// in for the CSRF token that cannot be sent with the upgrade request.
+var upgrader = websocket.Upgrader{}
+
+// songJSON is how songs are sent to JSON clients. Duration is the length of
+// the video, PlaybackDuration how long it plays at the song's speed.
+type songJSON struct {
+	ID               int     `json:"id"`
+	Title            string  `json:"title"`
+	URL              string  `json:"url"`
+	LyricsURL        string  `json:"lyricsUrl,omitempty"`
+	Thumbnail        string  `json:"thumbnail"`
+	Requester        User    `json:"requester"`
+	Duration         float64 `json:"duration"`
+	PlaybackDuration float64 `json:"playbackDuration"`
+	Key              int     `json:"key"`
+	Speed            float64 `json:"speed"`
+	ReduceVocals     bool    `json:"reduceVocals"`
+}
+
+func newSongJSON(s Song) songJSON {
+	return songJSON{
+		ID:               s.ID,
+		Title:            s.Title,
+		URL:              s.URL,
+		LyricsURL:        s.LyricsURL.String,
+		Thumbnail:        s.Thumbnail,
+		Requester:        s.Requester,
+		Duration:         s.Duration.Seconds(),
+		PlaybackDuration: s.PlaybackDuration().Seconds(),
+		Key:              s.Key,
+		Speed:            s.PlaybackSpeed(),
+		ReduceVocals:     s.ReduceVocals,
+	}
+}
+
+// wsMessage is sent to WebSocket clients, either a queue event or the reply
+// to a command.
+type wsMessage struct {
+	ID     string     `json:"id,omitempty"`
+	Type   string     `json:"type"`
+	Ref    string     `json:"ref,omitempty"`
+	Song   *songJSON  `json:"song,omitempty"`
+	Songs  []songJSON `json:"songs,omitempty"`
+	SongID int        `json:"songId,omitempty"`
+	User   *User      `json:"user,omitempty"`
+	Wait   float64    `json:"wait,omitempty"`
+	Emoji  string     `json:"emoji,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// wsCommand is sent by WebSocket clients. Ref is echoed in the reply.
+type wsCommand struct {
+	Ref    string `json:"ref"`
+	Type   string `json:"type"`
+	SongID int    `json:"songId"`
+	Emoji  string `json:"emoji"`
+	playbackAdjustment
+}
+
+// eventMessage converts a queue event for a user, reporting false if the
+// user should not get it.
+func eventMessage(user User, e queueEvent) (wsMessage, bool) {
+	if e.Event == SingerCall && e.Song.Requester.ID != user.ID {
+		return wsMessage{}, false
+	}
+
+	m := wsMessage{ID: e.ID, Type: string(e.Event), SongID: e.SongID, Emoji: e.Emoji}
+
+	switch e.Event {
+	case AppendQueue, UpdateQueue, SingerCall, PlaybackStart, PlaybackEnd:
+		song := newSongJSON(e.Song)
+		m.Song = &song
+		m.SongID = song.ID
+	case RerenderQueue:
+		m.Songs = make([]songJSON, 0, len(e.Songs))
+		for _, s := range e.Songs {
+			m.Songs = append(m.Songs, newSongJSON(s))
+		}
+	}
+
+	if e.Event == SingerCall {
+		m.Wait = e.Wait.Seconds()
+	}
+
+	if e.User.ID != "" {
+		m.User = &e.User
+	}
+
+	return m, true
+}
+
+// HandleWebSocket sends the same events as HandleSSE as JSON, and takes
+// commands from the client.
+func (h *QueueHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userKey).(User)
+	refresh := r.Context().Value(refreshUserKey).(refreshUser)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already responded
+		return
+	}
+	defer conn.Close()
+
+	songs, unlock := h.queue.Freeze()
+	sub, replay, ok := h.events.subscribe(r.URL.Query().Get("lastEventId"))
+	unlock()
+	defer func() { h.events.unsubscribe(sub) }()
+	h.incConnection(user)
+	defer h.decConnection(user)
+
+	replies := make(chan wsMessage, 16)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		defer close(done)
+		h.readCommands(r.Context(), conn, refresh, replies, stop)
+	}()
+
+	send := func(e queueEvent) error {
+		m, ok := eventMessage(user, e)
+		if !ok {
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteJSON(m)
+	}
+
+	if ok {
+		for _, e := range replay {
+			if err := send(e); err != nil {
+				return
+			}
+		}
+	} else if err := send(queueEvent{ID: sub.lastID, Event: RerenderQueue, Songs: songs}); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-done:
+			return
+		case <-sub.lagged:
+			// The client missed events, start over from the current queue.
+			songs, unlock := h.queue.Freeze()
+			sub, _, _ = h.events.subscribe("")
+			unlock()
+			err = send(queueEvent{ID: sub.lastID, Event: RerenderQueue, Songs: songs})
+		case event := <-sub.events:
+			err = send(event)
+		case m := <-replies:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err = conn.WriteJSON(m)
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readCommands runs commands from the client until the connection breaks,
+// passing the replies on to be written. The user is looked up again for every
+// command, as they may have lost permissions or logged out since connecting.
+func (h *QueueHandler) readCommands(ctx context.Context, conn *websocket.Conn, refresh refreshUser, replies chan<- wsMessage, stop <-chan struct{}) {
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	reactions := RateLimit{Count: 5, Interval: 10 * time.Second}.newLimiter()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		user, ok := refresh(ctx)
+		if !ok {
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "you are no longer logged in"),
+				time.Now().Add(wsWriteTimeout))
+			return
+		}
+
+		var cmd wsCommand
+		reply := wsMessage{Type: "ok"}
+
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			reply = wsMessage{Type: "error", Error: "invalid command"}
+		} else if err := h.runCommand(user, cmd, reactions.Allow); err != nil {
+			reply = wsMessage{Type: "error", Error: err.Error()}
+		}
+		reply.Ref = cmd.Ref
+
+		select {
+		case replies <- reply:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (h *QueueHandler) runCommand(user User, cmd wsCommand, allowReaction func() bool) error {
+	switch cmd.Type {
+	case "reaction":
+		if !user.Can(PermRequest) {
+			return errUnauthorized
+		}
+		if !slices.Contains(allowedReactions, cmd.Emoji) {
+			return errors.New("unknown reaction")
+		}
+		if !allowReaction() {
+			return errors.New("too many reactions")
+		}
+		h.sendEvent(queueEvent{Event: Reaction, User: user, Emoji: cmd.Emoji})
+		return nil
+	case "ready":
+		if !h.readiness.Confirm(user) {
+			return errors.New("it is not your turn right now")
+		}
+		return nil
+	case "skip":
+		return h.skip(user, cmd.SongID)
+	case "adjust":
+		if !user.Can(PermPlaybackControl) {
+			return errUnauthorized
+		}
+
+		updates, err := cmd.updates()
+		if err != nil {
+			return err
+		}
+
+		return h.adjust(cmd.SongID, updates)
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Type)
+	}
+}